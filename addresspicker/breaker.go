@@ -0,0 +1,175 @@
+package addresspicker
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// BreakerConfig config for Breaker
+type BreakerConfig struct {
+	// Failures is the number of consecutive failures to open the breaker
+	// of an address
+	Failures int
+	// Cooldown is the duration an address is skipped after its breaker
+	// opened, then one dial is let through to probe it.
+	Cooldown time.Duration
+}
+
+// Breaker wraps an address picker and skips addresses failing continuously,
+// dial results are reported by exnet.Cluster through AddressPickerConcern.
+// If all addresses are broken, the address from the wrapped picker is
+// returned anyway.
+type Breaker struct {
+	picker   picker
+	failures int
+	cooldown time.Duration
+
+	mtx    sync.Mutex
+	states map[string]*breakerState
+}
+
+type picker interface {
+	Addr() net.Addr
+}
+
+type updatablePicker interface {
+	picker
+	Updater
+}
+
+type concern interface {
+	Connected(net.Addr)
+	Disconnected(net.Addr)
+	Failure(net.Addr, error)
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// UpdatableBreaker is a Breaker wrapping an Updater
+type UpdatableBreaker struct {
+	*Breaker
+}
+
+var _ Updater = &UpdatableBreaker{}
+
+// NewBreaker wrap picker with circuit breakers, use NewUpdatableBreaker
+// if addresses of the picker are updated.
+func NewBreaker(p picker, conf *BreakerConfig) *Breaker {
+	if conf == nil {
+		panic("BreakerConfig can't be nil")
+	}
+	return &Breaker{
+		picker:   p,
+		failures: conf.Failures,
+		cooldown: conf.Cooldown,
+		states:   make(map[string]*breakerState),
+	}
+}
+
+// Addr return a net address whose breaker is not open
+func (b *Breaker) Addr() net.Addr {
+	var first net.Addr
+	for i := b.openCount(); i >= 0; i-- {
+		addr := b.picker.Addr()
+		if addr == nil {
+			return nil
+		}
+		if b.allow(addr) {
+			return addr
+		}
+		if first == nil {
+			first = addr
+		}
+	}
+	return first
+}
+
+// Connected close the breaker of addr
+func (b *Breaker) Connected(addr net.Addr) {
+	b.mtx.Lock()
+	delete(b.states, addrKey(addr))
+	b.mtx.Unlock()
+
+	if c, ok := b.picker.(concern); ok {
+		c.Connected(addr)
+	}
+}
+
+// Disconnected is passed to the wrapped picker
+func (b *Breaker) Disconnected(addr net.Addr) {
+	if c, ok := b.picker.(concern); ok {
+		c.Disconnected(addr)
+	}
+}
+
+// Failure count failures of addr, open its breaker if there are too many
+func (b *Breaker) Failure(addr net.Addr, err error) {
+	b.mtx.Lock()
+	key := addrKey(addr)
+	st, ok := b.states[key]
+	if !ok {
+		st = &breakerState{}
+		b.states[key] = st
+	}
+	st.failures++
+	if st.failures >= b.failures {
+		st.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.mtx.Unlock()
+
+	if c, ok := b.picker.(concern); ok {
+		c.Failure(addr, err)
+	}
+}
+
+// NewUpdatableBreaker wrap an Updater with circuit breakers
+func NewUpdatableBreaker(p updatablePicker, conf *BreakerConfig) *UpdatableBreaker {
+	return &UpdatableBreaker{NewBreaker(p, conf)}
+}
+
+// Update is passed to the wrapped picker, all breakers are reset
+func (b *UpdatableBreaker) Update(endpoints []Endpoint) {
+	b.picker.(Updater).Update(endpoints)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.states = make(map[string]*breakerState)
+}
+
+func (b *Breaker) allow(addr net.Addr) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	st, ok := b.states[addrKey(addr)]
+	if !ok || st.failures < b.failures {
+		return true
+	}
+	now := time.Now()
+	if now.Before(st.openUntil) {
+		return false
+	}
+	// half-open, let one dial probe the address in every cooldown
+	st.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *Breaker) openCount() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	n := 0
+	for _, st := range b.states {
+		if st.failures >= b.failures {
+			n++
+		}
+	}
+	return n
+}
+
+func addrKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
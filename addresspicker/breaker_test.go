@@ -0,0 +1,57 @@
+package addresspicker_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func TestBreaker(t *testing.T) {
+	a1 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8001}
+	a2 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8002}
+	b := addresspicker.NewBreaker(addresspicker.NewRoundRobin([]net.Addr{a1, a2}),
+		&addresspicker.BreakerConfig{Failures: 2, Cooldown: 20 * time.Millisecond})
+
+	// a single failure doesn't open the breaker
+	b.Failure(a1, errors.New("refused"))
+	assert.Equal(t, a1, b.Addr())
+	assert.Equal(t, a2, b.Addr())
+
+	b.Failure(a1, errors.New("refused"))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, a2, b.Addr())
+	}
+
+	// all broken, fail open
+	b.Failure(a2, errors.New("refused"))
+	b.Failure(a2, errors.New("refused"))
+	assert.NotNil(t, b.Addr())
+
+	// half-open after cooldown, a success closes the breaker
+	time.Sleep(30 * time.Millisecond)
+	b.Connected(a1)
+	b.Connected(a2)
+	assert.ElementsMatch(t, []net.Addr{a1, a2}, []net.Addr{b.Addr(), b.Addr()})
+}
+
+func TestUpdatableBreaker(t *testing.T) {
+	a1 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8001}
+	a2 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8002}
+	conf := &addresspicker.BreakerConfig{Failures: 1, Cooldown: time.Minute}
+
+	// only a Breaker wrapping an Updater is an Updater
+	var ap interface{} = addresspicker.NewBreaker(addresspicker.NewRoundRobin([]net.Addr{a1}), conf)
+	_, ok := ap.(addresspicker.Updater)
+	assert.False(t, ok)
+
+	b := addresspicker.NewUpdatableBreaker(addresspicker.NewRoundRobin([]net.Addr{a1}), conf)
+	b.Failure(a1, errors.New("refused"))
+	b.Update([]addresspicker.Endpoint{{Addr: a1}, {Addr: a2}})
+	// breakers are reset
+	assert.ElementsMatch(t, []net.Addr{a1, a2}, []net.Addr{b.Addr(), b.Addr()})
+}
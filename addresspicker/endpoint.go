@@ -0,0 +1,71 @@
+package addresspicker
+
+import (
+	"net"
+)
+
+// Endpoint is an address of a service with its metadata
+type Endpoint struct {
+	Addr net.Addr
+	// Weight is used by weighted pickers, 0 is treated as 1
+	Weight int
+	// Zone the address located in, e.g. IDC or availability zone
+	Zone string
+	// Tags are free form labels of the address
+	Tags []string
+}
+
+// Updater is an address picker whose addresses can be replaced at runtime,
+// Update must be atomic to concurrent calls of Addr.
+type Updater interface {
+	Update(endpoints []Endpoint)
+}
+
+// Addrs return addresses of endpoints
+func Addrs(endpoints []Endpoint) []net.Addr {
+	addrs := make([]net.Addr, 0, len(endpoints))
+	for _, ep := range endpoints {
+		addrs = append(addrs, ep.Addr)
+	}
+	return addrs
+}
+
+// HostAddr is a resolved tcp address which remembers the host name it is
+// resolved from, the name is used as TLS server name when dialing it.
+type HostAddr struct {
+	*net.TCPAddr
+	Host string
+}
+
+// ServerName return the host name of the address
+func (a *HostAddr) ServerName() string {
+	return a.Host
+}
+
+// ResolveTCPAddr works like net.ResolveTCPAddr, but return a HostAddr if
+// the host of address is a name instead of an IP.
+func ResolveTCPAddr(network, address string) (net.Addr, error) {
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	return &HostAddr{TCPAddr: addr, Host: host}, nil
+}
+
+// ResolveUnixAddr works like net.ResolveUnixAddr, but only accepts stream
+// networks, unix and unixpacket, which can be dialed by Cluster.
+func ResolveUnixAddr(network, address string) (net.Addr, error) {
+	switch network {
+	case "unix", "unixpacket":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if address == "" {
+		return nil, &net.AddrError{Err: "missing address", Addr: address}
+	}
+	return net.ResolveUnixAddr(network, address)
+}
@@ -0,0 +1,406 @@
+package addresspicker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultFamilyCooldown = 30 * time.Second
+
+// FamilyPolicy decides which IP families of a dual-stack host are used, and
+// in which order.
+type FamilyPolicy int
+
+const (
+	// FamilyAny keeps the order of the resolver
+	FamilyAny FamilyPolicy = iota
+	// PreferIPv4 uses IPv4 addresses before IPv6 ones
+	PreferIPv4
+	// PreferIPv6 uses IPv6 addresses before IPv4 ones
+	PreferIPv6
+	// IPv4Only uses IPv4 addresses only
+	IPv4Only
+	// IPv6Only uses IPv6 addresses only
+	IPv6Only
+	// HappyEyeballs interleaves IPv6 and IPv4 addresses starting with IPv6,
+	// and exnet.Dialer dials the next one if the previous doesn't connect
+	// in FallbackDelay, see RFC 8305.
+	HappyEyeballs
+)
+
+// Order return addrs ordered and filtered by the policy
+func (p FamilyPolicy) Order(addrs []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	switch p {
+	case PreferIPv4:
+		return append(v4, v6...)
+	case PreferIPv6:
+		return append(v6, v4...)
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case HappyEyeballs:
+		ordered := make([]net.IPAddr, 0, len(addrs))
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v6) {
+				ordered = append(ordered, v6[i])
+			}
+			if i < len(v4) {
+				ordered = append(ordered, v4[i])
+			}
+		}
+		return ordered
+	}
+	return addrs
+}
+
+// FamilyConfig config of IP family policy
+type FamilyConfig struct {
+	Policy FamilyPolicy
+	// FallbackDelay is the delay of HappyEyeballs before exnet.Dialer dials
+	// the next address, default is 250ms.
+	FallbackDelay time.Duration
+	// Failures is the number of consecutive failures of a family to stop
+	// using it, if the other family is available. 0 means never.
+	Failures int
+	// Cooldown is the duration a failing family is not used, then one dial
+	// is let through to probe it, default is 30 seconds.
+	Cooldown time.Duration
+}
+
+// FamilyStats counts dial results of IPv4 and IPv6, a family failing
+// continuously is broken for a cooldown, e.g. a host without IPv6 route.
+type FamilyStats struct {
+	failures int
+	cooldown time.Duration
+
+	mtx sync.Mutex
+	// IPv4 and IPv6
+	families [2]familyState
+}
+
+type familyState struct {
+	consecutive int
+	brokenUntil time.Time
+	successes   int64
+	failures    int64
+}
+
+// NewFamilyStats create FamilyStats by Failures and Cooldown of conf
+func NewFamilyStats(conf *FamilyConfig) *FamilyStats {
+	if conf == nil {
+		panic("FamilyConfig can't be nil")
+	}
+	s := &FamilyStats{failures: conf.Failures, cooldown: conf.Cooldown}
+	if s.cooldown <= 0 {
+		s.cooldown = defaultFamilyCooldown
+	}
+	return s
+}
+
+func family(ip net.IP) int {
+	if ip != nil && ip.To4() == nil {
+		return 1
+	}
+	return 0
+}
+
+// Success count a successful dial to ip, its family is not broken anymore
+func (s *FamilyStats) Success(ip net.IP) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st := &s.families[family(ip)]
+	st.successes++
+	st.consecutive = 0
+}
+
+// Failure count a failed dial to ip
+func (s *FamilyStats) Failure(ip net.IP) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st := &s.families[family(ip)]
+	st.failures++
+	st.consecutive++
+	if s.failures > 0 && st.consecutive >= s.failures {
+		st.brokenUntil = time.Now().Add(s.cooldown)
+	}
+}
+
+// usable report whether family f is not broken, a broken family is usable
+// after cooldown until it's probed by Attempt.
+func (s *FamilyStats) usable(f int) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st := &s.families[f]
+	return s.failures <= 0 || st.consecutive < s.failures || !time.Now().Before(st.brokenUntil)
+}
+
+// Attempt report a dial to ip is attempted, if its family is broken, the
+// dial probes it and the family is not usable for another cooldown.
+func (s *FamilyStats) Attempt(ip net.IP) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st := &s.families[family(ip)]
+	if s.failures <= 0 || st.consecutive < s.failures {
+		return
+	}
+	if now := time.Now(); !now.Before(st.brokenUntil) {
+		st.brokenUntil = now.Add(s.cooldown)
+	}
+}
+
+// Filter remove addresses of broken families, unless none is left. The
+// probe of a broken family is taken by Attempt, when one of its addresses
+// is dialed.
+func (s *FamilyStats) Filter(addrs []net.IPAddr) []net.IPAddr {
+	usable := [2]bool{s.usable(0), s.usable(1)}
+	if usable[0] && usable[1] {
+		return addrs
+	}
+	filtered := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if usable[family(addr.IP)] {
+			filtered = append(filtered, addr)
+		}
+	}
+	if len(filtered) == 0 {
+		return addrs
+	}
+	return filtered
+}
+
+// Metrics of dials by family
+func (s *FamilyStats) Metrics() map[string]int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	m := make(map[string]int64)
+	for i, name := range []string{"ipv4", "ipv6"} {
+		st := s.families[i]
+		m[name+"_successes"] = st.successes
+		m[name+"_failures"] = st.failures
+		broken := int64(0)
+		if s.failures > 0 && st.consecutive >= s.failures && now.Before(st.brokenUntil) {
+			broken = 1
+		}
+		m[name+"_broken"] = broken
+	}
+	return m
+}
+
+// ResolveTCPAddrs resolve all addresses of a host, ordered and filtered by
+// policy, addresses are HostAddr if the host is a name.
+func ResolveTCPAddrs(network, address string, policy FamilyPolicy) ([]net.Addr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		addr, err := ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Addr{addr}, nil
+	}
+	portnum, err := net.DefaultResolver.LookupPort(context.Background(), network, port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp4":
+		ips = IPv4Only.Order(ips)
+	case "tcp6":
+		ips = IPv6Only.Order(ips)
+	}
+	ips = policy.Order(ips)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	addrs := make([]net.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &HostAddr{TCPAddr: &net.TCPAddr{IP: ip.IP, Port: portnum, Zone: ip.Zone}, Host: host})
+	}
+	return addrs, nil
+}
+
+// FamilyPicker picks addresses round robin by an IP family policy, dial
+// results reported by exnet.Cluster through AddressPickerConcern are
+// counted, so a broken family stops being picked. Addresses not over IP
+// are treated as IPv4. FamilyAny keeps the order of the addresses, and
+// HappyEyeballs alternates the families.
+type FamilyPicker struct {
+	policy FamilyPolicy
+	stats  *FamilyStats
+
+	mtx sync.Mutex
+	// IPv4 and IPv6 addresses, and all of them in order for FamilyAny
+	addrs  [2][]net.Addr
+	idx    [2]int
+	all    []net.Addr
+	allIdx int
+	turn   int
+}
+
+var _ Updater = &FamilyPicker{}
+
+// NewFamilyPicker create a FamilyPicker
+func NewFamilyPicker(addrs []net.Addr, conf *FamilyConfig) *FamilyPicker {
+	if conf == nil {
+		panic("FamilyConfig can't be nil")
+	}
+	p := &FamilyPicker{policy: conf.Policy, stats: NewFamilyStats(conf)}
+	p.setAddrs(addrs)
+	return p
+}
+
+// AppendTCPAddress append all addresses of a host
+func (p *FamilyPicker) AppendTCPAddress(network, address string) error {
+	addrs, err := ResolveTCPAddrs(network, address, FamilyAny)
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, addr := range addrs {
+		f := addrFamily(addr)
+		p.addrs[f] = append(p.addrs[f], addr)
+		p.all = append(p.all, addr)
+	}
+	return nil
+}
+
+// Update replace the addresses
+func (p *FamilyPicker) Update(endpoints []Endpoint) {
+	p.setAddrs(Addrs(endpoints))
+}
+
+func (p *FamilyPicker) setAddrs(addrs []net.Addr) {
+	var families [2][]net.Addr
+	for _, addr := range addrs {
+		f := addrFamily(addr)
+		families[f] = append(families[f], addr)
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.addrs = families
+	p.idx = [2]int{-1, -1}
+	p.all = append([]net.Addr(nil), addrs...)
+	p.allIdx = -1
+}
+
+// Addr return an address of the family chosen by the policy, nil if there
+// is none.
+func (p *FamilyPicker) Addr() net.Addr {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var order []int
+	switch p.policy {
+	case FamilyAny:
+		return p.nextAny()
+	case IPv4Only:
+		order = []int{0}
+	case IPv6Only:
+		order = []int{1}
+	case PreferIPv4:
+		order = []int{0, 1}
+	case PreferIPv6:
+		order = []int{1, 0}
+	default:
+		p.turn = 1 - p.turn
+		order = []int{p.turn, 1 - p.turn}
+	}
+	f := -1
+	for _, candidate := range order {
+		if len(p.addrs[candidate]) == 0 {
+			continue
+		}
+		if f < 0 {
+			// used if all are broken
+			f = candidate
+		}
+		if p.stats.usable(candidate) {
+			f = candidate
+			break
+		}
+	}
+	if f < 0 {
+		return nil
+	}
+	p.idx[f]++
+	if p.idx[f] >= len(p.addrs[f]) {
+		p.idx[f] = 0
+	}
+	addr := p.addrs[f][p.idx[f]]
+	p.stats.Attempt(addrIP(addr))
+	return addr
+}
+
+// nextAny return the next address in order whose family is not broken, or
+// the next one if all are broken. The caller must hold mtx.
+func (p *FamilyPicker) nextAny() net.Addr {
+	n := len(p.all)
+	if n == 0 {
+		return nil
+	}
+	next := (p.allIdx + 1) % n
+	for i := 1; i <= n; i++ {
+		j := (p.allIdx + i) % n
+		if p.stats.usable(addrFamily(p.all[j])) {
+			next = j
+			break
+		}
+	}
+	p.allIdx = next
+	addr := p.all[next]
+	p.stats.Attempt(addrIP(addr))
+	return addr
+}
+
+// Connected count a success of the family of addr
+func (p *FamilyPicker) Connected(addr net.Addr) {
+	p.stats.Success(addrIP(addr))
+}
+
+// Disconnected does nothing
+func (p *FamilyPicker) Disconnected(addr net.Addr) {}
+
+// Failure count a failure of the family of addr
+func (p *FamilyPicker) Failure(addr net.Addr, err error) {
+	p.stats.Failure(addrIP(addr))
+}
+
+// Metrics of dials by family, see FamilyStats
+func (p *FamilyPicker) Metrics() map[string]int64 {
+	return p.stats.Metrics()
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *HostAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func addrFamily(addr net.Addr) int {
+	return family(addrIP(addr))
+}
@@ -0,0 +1,94 @@
+package addresspicker_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func TestFamilyPolicyOrder(t *testing.T) {
+	var addrs []net.IPAddr
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "::1", "::2", "::3"} {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	order := func(p addresspicker.FamilyPolicy) []string {
+		var ips []string
+		for _, addr := range p.Order(addrs) {
+			ips = append(ips, addr.IP.String())
+		}
+		return ips
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "::1", "::2", "::3"}, order(addresspicker.FamilyAny))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "::1", "::2", "::3"}, order(addresspicker.PreferIPv4))
+	assert.Equal(t, []string{"::1", "::2", "::3", "10.0.0.1", "10.0.0.2"}, order(addresspicker.PreferIPv6))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, order(addresspicker.IPv4Only))
+	assert.Equal(t, []string{"::1", "::2", "::3"}, order(addresspicker.IPv6Only))
+	assert.Equal(t, []string{"::1", "10.0.0.1", "::2", "10.0.0.2", "::3"}, order(addresspicker.HappyEyeballs))
+}
+
+func TestFamilyPicker(t *testing.T) {
+	a1 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8001}
+	a2 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8002}
+	a6 := &net.TCPAddr{IP: net.IPv6loopback, Port: 8001}
+	addrs := []net.Addr{a1, a6, a2}
+
+	p := addresspicker.NewFamilyPicker(addrs, &addresspicker.FamilyConfig{Policy: addresspicker.IPv4Only})
+	assert.Equal(t, []net.Addr{a1, a2, a1}, []net.Addr{p.Addr(), p.Addr(), p.Addr()})
+	p = addresspicker.NewFamilyPicker([]net.Addr{a6}, &addresspicker.FamilyConfig{Policy: addresspicker.IPv4Only})
+	assert.Nil(t, p.Addr())
+	p = addresspicker.NewFamilyPicker(addrs, &addresspicker.FamilyConfig{Policy: addresspicker.HappyEyeballs})
+	assert.Equal(t, []net.Addr{a6, a1, a6, a2}, []net.Addr{p.Addr(), p.Addr(), p.Addr(), p.Addr()})
+	p = addresspicker.NewFamilyPicker(addrs, &addresspicker.FamilyConfig{Policy: addresspicker.FamilyAny})
+	assert.Equal(t, []net.Addr{a1, a6, a2, a1}, []net.Addr{p.Addr(), p.Addr(), p.Addr(), p.Addr()})
+
+	// a broken family is skipped until cooldown
+	p = addresspicker.NewFamilyPicker(addrs, &addresspicker.FamilyConfig{
+		Policy:   addresspicker.PreferIPv6,
+		Failures: 2,
+		Cooldown: 20 * time.Millisecond,
+	})
+	assert.Equal(t, a6, p.Addr())
+	p.Failure(a6, errors.New("unreachable"))
+	assert.Equal(t, a6, p.Addr())
+	p.Failure(a6, errors.New("unreachable"))
+	assert.Equal(t, []net.Addr{a1, a2}, []net.Addr{p.Addr(), p.Addr()})
+	assert.Equal(t, int64(1), p.Metrics()["ipv6_broken"])
+	assert.Equal(t, int64(2), p.Metrics()["ipv6_failures"])
+
+	// probed after cooldown
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, a6, p.Addr())
+	assert.Equal(t, a1, p.Addr())
+	p.Connected(a6)
+	assert.Equal(t, a6, p.Addr())
+	assert.Equal(t, int64(0), p.Metrics()["ipv6_broken"])
+	assert.Equal(t, int64(1), p.Metrics()["ipv6_successes"])
+
+	// the only family is used even if it's broken
+	p.Update([]addresspicker.Endpoint{{Addr: a6}})
+	p.Failure(a6, errors.New("unreachable"))
+	p.Failure(a6, errors.New("unreachable"))
+	assert.Equal(t, a6, p.Addr())
+}
+
+func TestFamilyStatsProbe(t *testing.T) {
+	v4, v6 := net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}, net.IPAddr{IP: net.ParseIP("::1")}
+	s := addresspicker.NewFamilyStats(&addresspicker.FamilyConfig{Failures: 1, Cooldown: 20 * time.Millisecond})
+	s.Failure(v6.IP)
+	assert.Equal(t, []net.IPAddr{v4}, s.Filter([]net.IPAddr{v6, v4}))
+
+	// the probe is taken only when an address of the family is dialed
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []net.IPAddr{v4}, s.Filter([]net.IPAddr{v4}))
+	assert.Equal(t, []net.IPAddr{v6, v4}, s.Filter([]net.IPAddr{v6, v4}))
+	assert.Equal(t, []net.IPAddr{v6, v4}, s.Filter([]net.IPAddr{v6, v4}))
+	s.Attempt(v4.IP)
+	assert.Equal(t, []net.IPAddr{v6, v4}, s.Filter([]net.IPAddr{v6, v4}))
+	s.Attempt(v6.IP)
+	assert.Equal(t, []net.IPAddr{v4}, s.Filter([]net.IPAddr{v6, v4}))
+}
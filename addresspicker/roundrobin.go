@@ -12,6 +12,8 @@ type RoundRobin struct {
 	mtx   sync.Mutex
 }
 
+var _ Updater = &RoundRobin{}
+
 // NewRoundRobin address picker
 func NewRoundRobin(addrs []net.Addr) *RoundRobin {
 	return &RoundRobin{
@@ -20,9 +22,21 @@ func NewRoundRobin(addrs []net.Addr) *RoundRobin {
 	}
 }
 
-// AppendTCPAddress append tcp address
+// AppendTCPAddress append tcp address, host name is resolved once and kept
+// as TLS server name.
 func (rr *RoundRobin) AppendTCPAddress(network, address string) error {
-	addr, err := net.ResolveTCPAddr(network, address)
+	addr, err := ResolveTCPAddr(network, address)
+	if err != nil {
+		return err
+	}
+	rr.appendAddr(addr)
+	return nil
+}
+
+// AppendUnixAddress append unix address, network is unix or unixpacket. On
+// Linux, a name starting with @ is in the abstract namespace.
+func (rr *RoundRobin) AppendUnixAddress(network, address string) error {
+	addr, err := ResolveUnixAddr(network, address)
 	if err != nil {
 		return err
 	}
@@ -30,18 +44,31 @@ func (rr *RoundRobin) AppendTCPAddress(network, address string) error {
 	return nil
 }
 
-// Addr return a net address
+// Addr return a net address, nil if there is no address
 func (rr *RoundRobin) Addr() net.Addr {
 	rr.mtx.Lock()
 	defer rr.mtx.Unlock()
 
+	if len(rr.addrs) == 0 {
+		return nil
+	}
 	rr.idx++
-	if rr.idx == len(rr.addrs) {
+	if rr.idx >= len(rr.addrs) {
 		rr.idx = 0
 	}
 	return rr.addrs[rr.idx]
 }
 
+// Update replace all addresses with endpoints, weights are ignored.
+func (rr *RoundRobin) Update(endpoints []Endpoint) {
+	addrs := Addrs(endpoints)
+
+	rr.mtx.Lock()
+	defer rr.mtx.Unlock()
+
+	rr.addrs = addrs
+}
+
 func (rr *RoundRobin) appendAddr(addr net.Addr) {
 	rr.mtx.Lock()
 	defer rr.mtx.Unlock()
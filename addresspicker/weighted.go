@@ -0,0 +1,66 @@
+package addresspicker
+
+import (
+	"net"
+	"sync"
+)
+
+// WeightedRoundRobin is the smooth weighted round robin load balance strategy,
+// addresses with higher weight are picked more often but never in a burst.
+type WeightedRoundRobin struct {
+	peers []*weightedPeer
+	mtx   sync.Mutex
+}
+
+type weightedPeer struct {
+	addr    net.Addr
+	weight  int
+	current int
+}
+
+var _ Updater = &WeightedRoundRobin{}
+
+// NewWeightedRoundRobin address picker
+func NewWeightedRoundRobin(endpoints []Endpoint) *WeightedRoundRobin {
+	wrr := &WeightedRoundRobin{}
+	wrr.Update(endpoints)
+	return wrr
+}
+
+// Addr return a net address, nil if there is no address
+func (wrr *WeightedRoundRobin) Addr() net.Addr {
+	wrr.mtx.Lock()
+	defer wrr.mtx.Unlock()
+
+	var best *weightedPeer
+	total := 0
+	for _, p := range wrr.peers {
+		p.current += p.weight
+		total += p.weight
+		if best == nil || p.current > best.current {
+			best = p
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.current -= total
+	return best.addr
+}
+
+// Update replace all addresses with endpoints
+func (wrr *WeightedRoundRobin) Update(endpoints []Endpoint) {
+	peers := make([]*weightedPeer, 0, len(endpoints))
+	for _, ep := range endpoints {
+		weight := ep.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		peers = append(peers, &weightedPeer{addr: ep.Addr, weight: weight})
+	}
+
+	wrr.mtx.Lock()
+	defer wrr.mtx.Unlock()
+
+	wrr.peers = peers
+}
@@ -2,7 +2,10 @@ package exnet
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -16,21 +19,90 @@ var (
 
 // Cluster contain service info
 type Cluster struct {
+	// Deprecated: DialTimeout, ReadTimeout, WriteTimeout and AddressPicker
+	// are read by every dial until the first Update, changes after that
+	// are ignored. Set them before the cluster is shared by goroutines, or
+	// by NewCluster and Update, and read them by Config.
 	DialTimeout  time.Duration
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// Deprecated: see DialTimeout.
 	AddressPicker AddressPicker
-	connpool      ConnPool
 
-	tcpKeepAlive       bool
-	tcpKeepAlivePeriod time.Duration
-	tcpLinger          int
-	tcpNoDelay         bool
+	// initial settings from NewCluster
+	poolConf   *ConnPoolConfig
+	asyncPool  bool
+	retry      *RetryPolicy
+	tcpOptions TCPOptions
+	sockopts   *SocketOptions
+	sourceAddr *SourceAddrConfig
+	proxy      *ProxyConfig
+	egress     *EgressPolicy
+	tlsConfig  *tls.Config
+	maxDials   int
+	dialRate   *DialRateLimitConfig
+
+	// current *clusterSnapshot
+	snap     atomic.Value
+	snapOnce sync.Once
+	// snapMtx serializes changes of snap, and updated is set by Update
+	// to stop reading the deprecated fields
+	snapMtx sync.Mutex
+	updated int32
+	// updateMtx serializes updates, and keeps connections from being put
+	// into a pool which is being replaced
+	updateMtx sync.RWMutex
+
+	// dials in progress and callers waiting for them by address, see
+	// MaxDialsPerAddr
+	gatesMtx sync.Mutex
+	gates    map[string]*dialGate
+	// token buckets of DialRateLimit, kept on Update
+	limiter dialLimiter
 
 	// metrics
-	metricDialDirect    int64
-	metricDialPoolReuse int64
+	metricDialDirect           int64
+	metricDialPoolReuse        int64
+	metricDialRetry            int64
+	metricDialAddrNotAvailable int64
+	metricDialEgressDenied     int64
+	metricDialWait             int64
+	metricDialHandoff          int64
+	metricDialRateLimited      int64
+	metricUpdate               int64
+	metricInvalidated          int64
+}
+
+// clusterSnapshot is an immutable config of cluster, every dial uses the
+// snapshot when it starts even if the cluster is updated during dialing.
+type clusterSnapshot struct {
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	picker    AddressPicker
+	connpool  ConnPool
+	poolConf  *ConnPoolConfig
+	asyncPool bool
+	retry     *RetryPolicy
+	tcp       TCPOptions
+	sockopts  *SocketOptions
+	// sourceAddr is from ClusterConfig, source rotates its IPs
+	sourceAddr *SourceAddrConfig
+	source     *sourceAddrs
+	proxy      *ProxyConfig
+	egress     *EgressPolicy
+	// tlsConfig is from ClusterConfig, tls is a clone of it with a shared
+	// session cache
+	tlsConfig *tls.Config
+	tls       *tls.Config
+	maxDials  int
+	dialRate  *DialRateLimitConfig
+
+	// epoch changes when connections dialed before are incompatible with
+	// the new settings, e.g. different socket options.
+	epoch uint64
 }
 
 // ClusterConfig expose config for cluster
@@ -43,6 +115,75 @@ type ClusterConfig struct {
 	// connection pool settings
 	PoolConfig   *ConnPoolConfig
 	UseAsyncPool bool
+
+	// AddressPicker to pick address for dialing, on Update nil keeps the
+	// current one.
+	AddressPicker AddressPicker
+	// Retry redial when dial failed, nil means no retry
+	Retry *RetryPolicy
+	// TCPOptions set on every dialed tcp connection, nil means
+	// DefaultTCPOptions.
+	TCPOptions *TCPOptions
+	// SocketOptions set on every dialed tcp connection, nil means none, see
+	// SocketOptions.
+	SocketOptions *SocketOptions
+	// SourceAddr binds dialed connections to local IPs, nil means none
+	SourceAddr *SourceAddrConfig
+	// Proxy dials addresses through a forward proxy, nil means none
+	Proxy *ProxyConfig
+	// Egress denies dialing addresses by IP and port, nil means none, see
+	// Dialer.SetEgressPolicy.
+	Egress *EgressPolicy
+	// TLSConfig enables TLS on dialed connections, the handshake is a part
+	// of dialing. If ServerName is empty, it's derived from every picked
+	// address, see ServerNamer. A client session cache is added if it has
+	// none, so sessions are resumed across dials.
+	TLSConfig *tls.Config
+	// MaxDialsPerAddr bounds dials in progress to an address, 0 means no
+	// bound. Callers more than the dials wait, in order, for the
+	// connections dialed, or returned to the pool by Close, whichever comes
+	// first. Dials are not canceled with the callers, their connections
+	// are handed to the next callers or put into the pool. Dials with PROXY
+	// header are not bounded. A connection returned by Close goes to a
+	// caller waiting for its address first, or else to one waiting for
+	// another address, and the AddressPicker is not told of the connection
+	// handed across addresses.
+	MaxDialsPerAddr int
+	// DialRateLimit limits the rate of new connections dialed, nil means no
+	// limit. Connections reused from the pool are not limited.
+	DialRateLimit *DialRateLimitConfig
+
+	// InvalidateIncompatible closes pooled connections on Update if they
+	// were dialed with settings incompatible with the new config, otherwise
+	// they are reused until closed.
+	InvalidateIncompatible bool
+}
+
+// TCPOptions are socket options set on every dialed tcp connection
+type TCPOptions struct {
+	KeepAlive       bool
+	KeepAlivePeriod time.Duration
+	Linger          int
+	NoDelay         bool
+}
+
+// DefaultTCPOptions return the tcp options used by NewCluster
+func DefaultTCPOptions() *TCPOptions {
+	return &TCPOptions{
+		KeepAlive:       defaultTCPKeepAlive,
+		KeepAlivePeriod: defaultTCPKeepAlivePeriod,
+		Linger:          defaultTCPLinger,
+		NoDelay:         defaultTCPNoDelay,
+	}
+}
+
+// RetryPolicy to redial when a dial failed, every attempt picks an address
+// from AddressPicker again.
+type RetryPolicy struct {
+	// Attempts is the max number of dials including the first one
+	Attempts int
+	// Backoff is the duration to wait before every redial
+	Backoff time.Duration
 }
 
 // AddressPicker interface to get an address
@@ -50,6 +191,12 @@ type AddressPicker interface {
 	Addr() net.Addr
 }
 
+// ServerNamer is implemented by addresses which know their TLS server name,
+// e.g. the host name they are resolved from.
+type ServerNamer interface {
+	ServerName() string
+}
+
 // AddressPickerConcern interface to concern the address usage
 type AddressPickerConcern interface {
 	// Connected will be called when an address is connected
@@ -60,26 +207,332 @@ type AddressPickerConcern interface {
 	Failure(net.Addr, error)
 }
 
-// NewCluster create new cluster with config and default options.
+// NewCluster create new cluster with config and default options. The
+// settings of conf are copied, changes of conf after that take effect by
+// Update only.
 func NewCluster(conf *ClusterConfig) *Cluster {
+	conf = conf.clone()
 	c := &Cluster{
-		DialTimeout:        conf.DialTimeout,
-		ReadTimeout:        conf.ReadTimeout,
-		WriteTimeout:       conf.WriteTimeout,
-		AddressPicker:      nil,
-		tcpKeepAlive:       defaultTCPKeepAlive,
-		tcpKeepAlivePeriod: defaultTCPKeepAlivePeriod,
-		tcpLinger:          defaultTCPLinger,
-		tcpNoDelay:         defaultTCPNoDelay,
+		DialTimeout:   conf.DialTimeout,
+		ReadTimeout:   conf.ReadTimeout,
+		WriteTimeout:  conf.WriteTimeout,
+		AddressPicker: conf.AddressPicker,
+		poolConf:      conf.PoolConfig,
+		asyncPool:     conf.UseAsyncPool,
+		retry:         conf.Retry,
+		tcpOptions:    *DefaultTCPOptions(),
+		sockopts:      conf.SocketOptions,
+		sourceAddr:    conf.SourceAddr,
+		proxy:         conf.Proxy,
+		egress:        conf.Egress,
+		tlsConfig:     conf.TLSConfig,
+		maxDials:      conf.MaxDialsPerAddr,
+		dialRate:      conf.DialRateLimit,
+	}
+	if conf.TCPOptions != nil {
+		c.tcpOptions = *conf.TCPOptions
+	}
+	return c
+}
+
+// snapshot return the current config of cluster, the first call builds it
+// from fields of cluster, and the deprecated fields are synced into it
+// until Update is called.
+func (c *Cluster) snapshot() *clusterSnapshot {
+	c.snapOnce.Do(func() {
+		s := &clusterSnapshot{
+			dialTimeout:  c.DialTimeout,
+			readTimeout:  c.ReadTimeout,
+			writeTimeout: c.WriteTimeout,
+			picker:       c.AddressPicker,
+			poolConf:     c.poolConf,
+			asyncPool:    c.asyncPool,
+			retry:        c.retry,
+			tcp:          c.tcpOptions,
+			sockopts:     c.sockopts,
+			sourceAddr:   c.sourceAddr,
+			source:       newSourceAddrs(c.sourceAddr),
+			proxy:        c.proxy,
+			egress:       c.egress,
+			tlsConfig:    c.tlsConfig,
+			tls:          newClusterTLSConfig(c.tlsConfig),
+			maxDials:     c.maxDials,
+			dialRate:     c.dialRate,
+		}
+		s.connpool = newConnPool(s.poolConf, s.asyncPool)
+		c.snap.Store(s)
+	})
+	s := c.snap.Load().(*clusterSnapshot)
+	if atomic.LoadInt32(&c.updated) != 0 || c.fieldsSynced(s) {
+		return s
+	}
+
+	c.snapMtx.Lock()
+	defer c.snapMtx.Unlock()
+	s = c.snap.Load().(*clusterSnapshot)
+	if atomic.LoadInt32(&c.updated) != 0 || c.fieldsSynced(s) {
+		return s
+	}
+	synced := *s
+	synced.dialTimeout = c.DialTimeout
+	synced.readTimeout = c.ReadTimeout
+	synced.writeTimeout = c.WriteTimeout
+	synced.picker = c.AddressPicker
+	c.snap.Store(&synced)
+	return &synced
+}
+
+// fieldsSynced report whether the deprecated fields are the same as in s
+func (c *Cluster) fieldsSynced(s *clusterSnapshot) bool {
+	return s.dialTimeout == c.DialTimeout &&
+		s.readTimeout == c.ReadTimeout &&
+		s.writeTimeout == c.WriteTimeout &&
+		samePicker(s.picker, c.AddressPicker)
+}
+
+func samePicker(a, b AddressPicker) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return a == nil && b == nil
+	}
+	if !reflect.TypeOf(a).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// Config return a copy of current config of cluster, it can be changed and
+// passed to Update. AddressPicker and Egress are shared with the cluster as
+// they are updated in place.
+func (c *Cluster) Config() *ClusterConfig {
+	s := c.snapshot()
+	tcp := s.tcp
+	conf := &ClusterConfig{
+		DialTimeout:     s.dialTimeout,
+		ReadTimeout:     s.readTimeout,
+		WriteTimeout:    s.writeTimeout,
+		PoolConfig:      s.poolConf,
+		UseAsyncPool:    s.asyncPool,
+		AddressPicker:   s.picker,
+		Retry:           s.retry,
+		TCPOptions:      &tcp,
+		SocketOptions:   s.sockopts,
+		SourceAddr:      s.sourceAddr,
+		Proxy:           s.proxy,
+		Egress:          s.egress,
+		TLSConfig:       s.tlsConfig,
+		MaxDialsPerAddr: s.maxDials,
+		DialRateLimit:   s.dialRate,
+	}
+	return conf.clone()
+}
+
+// Picker return the current AddressPicker of cluster
+func (c *Cluster) Picker() AddressPicker {
+	return c.snapshot().picker
+}
+
+// Update atomically swap config of cluster, dials in progress keep using the
+// config when they started. The connection pool is replaced if pool settings
+// changed, pooled connections are moved into the new pool unless they are
+// incompatible with the new config and conf.InvalidateIncompatible is set.
+// The settings of conf are copied, it can be reused after Update.
+func (c *Cluster) Update(conf *ClusterConfig) error {
+	if conf == nil {
+		return ErrNilConfig
 	}
+	conf = conf.clone()
+	c.updateMtx.Lock()
+	defer c.updateMtx.Unlock()
+
+	old := c.snapshot()
+	s := &clusterSnapshot{
+		dialTimeout:  conf.DialTimeout,
+		readTimeout:  conf.ReadTimeout,
+		writeTimeout: conf.WriteTimeout,
+		picker:       conf.AddressPicker,
+		connpool:     old.connpool,
+		poolConf:     conf.PoolConfig,
+		asyncPool:    conf.UseAsyncPool,
+		retry:        conf.Retry,
+		tcp:          *DefaultTCPOptions(),
+		sockopts:     conf.SocketOptions,
+		sourceAddr:   conf.SourceAddr,
+		source:       old.source,
+		proxy:        conf.Proxy,
+		egress:       conf.Egress,
+		tlsConfig:    conf.TLSConfig,
+		tls:          old.tls,
+		maxDials:     conf.MaxDialsPerAddr,
+		dialRate:     conf.DialRateLimit,
+		epoch:        old.epoch,
+	}
+	if !sameTLSConfig(s.tlsConfig, old.tlsConfig) {
+		s.tls = newClusterTLSConfig(s.tlsConfig)
+	}
+	if !sameSourceAddr(s.sourceAddr, old.sourceAddr) {
+		s.source = newSourceAddrs(s.sourceAddr)
+	}
+	if s.picker == nil {
+		s.picker = old.picker
+	}
+	if conf.TCPOptions != nil {
+		s.tcp = *conf.TCPOptions
+	}
+	invalidate := conf.InvalidateIncompatible && !old.compatible(s)
+	if invalidate {
+		s.epoch++
+	}
+	if invalidate || !samePoolConfig(old, s) {
+		s.connpool = newConnPool(s.poolConf, s.asyncPool)
+	}
+	c.snapMtx.Lock()
+	atomic.StoreInt32(&c.updated, 1)
+	c.snap.Store(s)
+	c.snapMtx.Unlock()
+	atomic.AddInt64(&c.metricUpdate, 1)
+
+	if old.connpool != nil && old.connpool != s.connpool {
+		for conn := old.connpool.Get(); conn != nil; conn = old.connpool.Get() {
+			if invalidate || s.connpool == nil {
+				atomic.AddInt64(&c.metricInvalidated, 1)
+				_ = conn.Close()
+				continue
+			}
+			s.connpool.Put(conn)
+		}
+	}
+	return nil
+}
+
+// compatible report whether connections dialed with s can be used with other
+func (s *clusterSnapshot) compatible(other *clusterSnapshot) bool {
+	return s.tcp == other.tcp && sameSocketOptions(s.sockopts, other.sockopts) &&
+		sameProxyConfig(s.proxy, other.proxy) && sameTLSConfig(s.tlsConfig, other.tlsConfig)
+}
+
+// clone copy conf and the settings it points to, except AddressPicker and
+// Egress which are updated in place.
+func (conf *ClusterConfig) clone() *ClusterConfig {
+	c := *conf
 	if conf.PoolConfig != nil {
-		if conf.UseAsyncPool {
-			c.connpool = NewAsyncConnPool(conf.PoolConfig)
-		} else {
-			c.connpool = NewSyncConnPool(conf.PoolConfig)
+		pool := *conf.PoolConfig
+		c.PoolConfig = &pool
+	}
+	if conf.Retry != nil {
+		retry := *conf.Retry
+		c.Retry = &retry
+	}
+	if conf.TCPOptions != nil {
+		tcp := *conf.TCPOptions
+		c.TCPOptions = &tcp
+	}
+	if conf.SocketOptions != nil {
+		sockopts := *conf.SocketOptions
+		c.SocketOptions = &sockopts
+	}
+	if conf.SourceAddr != nil {
+		source := *conf.SourceAddr
+		source.IPs = make([]net.IP, len(conf.SourceAddr.IPs))
+		for i, ip := range conf.SourceAddr.IPs {
+			source.IPs[i] = append(net.IP(nil), ip...)
 		}
+		c.SourceAddr = &source
 	}
-	return c
+	if conf.Proxy != nil {
+		proxy := *conf.Proxy
+		c.Proxy = &proxy
+	}
+	if conf.DialRateLimit != nil {
+		rate := *conf.DialRateLimit
+		c.DialRateLimit = &rate
+	}
+	c.TLSConfig = conf.TLSConfig.Clone()
+	return &c
+}
+
+func sameProxyConfig(a, b *ProxyConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameSourceAddr(a, b *SourceAddrConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.IPs) != len(b.IPs) || a.BindAddressNoPort != b.BindAddressNoPort {
+		return false
+	}
+	for i := range a.IPs {
+		if !a.IPs[i].Equal(b.IPs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameTLSConfig compare exported fields of a and b, functions are equal if
+// they have the same code, as configs are copied by Update and Config.
+func sameTLSConfig(a, b *tls.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if va.Type().Field(i).PkgPath != "" {
+			// unexported
+			continue
+		}
+		fa, fb := va.Field(i), vb.Field(i)
+		if fa.Kind() == reflect.Func {
+			if fa.Pointer() != fb.Pointer() {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSocketOptions(a, b *SocketOptions) bool {
+	if a.isZero() || b.isZero() {
+		return a.isZero() == b.isZero()
+	}
+	return *a == *b
+}
+
+// newClusterTLSConfig clone conf with a client session cache shared by
+// all dials.
+func newClusterTLSConfig(conf *tls.Config) *tls.Config {
+	if conf == nil {
+		return nil
+	}
+	conf = conf.Clone()
+	if conf.ClientSessionCache == nil {
+		conf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return conf
+}
+
+func samePoolConfig(a, b *clusterSnapshot) bool {
+	if a.poolConf == nil || b.poolConf == nil {
+		return a.poolConf == b.poolConf
+	}
+	return *a.poolConf == *b.poolConf && a.asyncPool == b.asyncPool
+}
+
+func newConnPool(conf *ConnPoolConfig, async bool) ConnPool {
+	if conf == nil {
+		return nil
+	}
+	if async {
+		return NewAsyncConnPool(conf)
+	}
+	return NewSyncConnPool(conf)
 }
 
 // Dial create an empty context and dial with it
@@ -89,30 +542,103 @@ func (c *Cluster) Dial(network, addr string) (net.Conn, error) {
 
 // DialContext dial and return an exnet.Conn, network and address is useless, we use
 // AddressPicker to get one.
+// If ctx is from WithProxyHeader, a new connection is dialed and the PROXY
+// header is sent before TLS handshake.
 func (c *Cluster) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
-	if c.connpool != nil {
-		if conn := c.connpool.Get(); conn != nil {
-			if c.resetDeadlines(conn) == nil {
+	s := c.snapshot()
+	// a connection with PROXY header is dedicated to a client, never reuse
+	if s.connpool != nil && proxyHeaderFromContext(ctx) == nil {
+		if conn := s.connpool.Get(); conn != nil {
+			if s.resetDeadlines(conn) == nil {
 				atomic.AddInt64(&c.metricDialPoolReuse, 1)
-				return &Conn{_conn: conn, closer: c}, nil
+				return &Conn{_conn: conn, closer: c, epoch: s.epoch}, nil
 			}
 			_ = conn.Close()
 		}
 	}
 	atomic.AddInt64(&c.metricDialDirect, 1)
-	return c.dialContextDirect(ctx)
+	attempts := 1
+	if s.retry != nil && s.retry.Attempts > 1 {
+		attempts = s.retry.Attempts
+	}
+	var conn net.Conn
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if err = s.retryBackoff(ctx); err != nil {
+				break
+			}
+			atomic.AddInt64(&c.metricDialRetry, 1)
+		}
+		conn, err = c.dialContextDirect(ctx, s)
+		if err == nil || err == ErrNoAddressPicker || ctx.Err() != nil {
+			break
+		}
+		if _, ok := err.(*DialRateLimitError); ok {
+			break
+		}
+	}
+	return conn, err
+}
+
+func (s *clusterSnapshot) retryBackoff(ctx context.Context) error {
+	if s.retry.Backoff <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(s.retry.Backoff)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (c *Cluster) dialContextDirect(ctx context.Context, s *clusterSnapshot) (net.Conn, error) {
+	if s.picker == nil {
+		return nil, ErrNoAddressPicker
+	}
+	addr := s.picker.Addr()
+	if addr == nil {
+		return nil, ErrNoAddress
+	}
+	if s.maxDials > 0 && proxyHeaderFromContext(ctx) == nil {
+		return c.dialQueued(ctx, s, addr)
+	}
+	return c.dialAddr(ctx, s, addr)
 }
 
-func (c *Cluster) dialContextDirect(ctx context.Context) (net.Conn, error) {
-	addr := c.AddressPicker.Addr()
+// dialAddr dial addr with settings of s
+func (c *Cluster) dialAddr(ctx context.Context, s *clusterSnapshot, addr net.Addr) (net.Conn, error) {
+	if err := c.rateLimit(ctx, s, addr); err != nil {
+		return nil, err
+	}
 	dialer := &Dialer{
 		dialer: &net.Dialer{
-			Timeout: c.DialTimeout,
+			Timeout: s.dialTimeout,
 		},
 	}
+	if !s.sockopts.isZero() {
+		// options after connect are set by setupConn
+		dialer.dialer.Control = s.sockopts.control(nil)
+	}
+	if s.source != nil {
+		dialer.dialer.Control = s.source.control(dialer.dialer.Control)
+	}
+	dialer.SetProxy(s.proxy)
+	dialer.SetEgressPolicy(s.egress)
 	conn, err := dialer.DialContext(ctx, addr.Network(), addr.String())
+	switch err.(type) {
+	case nil:
+		err = s.setupConn(ctx, conn.(*Conn), addr)
+	case *AddrNotAvailableError:
+		atomic.AddInt64(&c.metricDialAddrNotAvailable, 1)
+	case *EgressError:
+		atomic.AddInt64(&c.metricDialEgressDenied, 1)
+	}
 	// concern
-	if apc, ok := c.AddressPicker.(AddressPickerConcern); ok {
+	if apc, ok := s.picker.(AddressPickerConcern); ok {
 		if err == nil {
 			apc.Connected(addr)
 		} else {
@@ -122,30 +648,102 @@ func (c *Cluster) dialContextDirect(ctx context.Context) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = s.resetDeadlines(conn)
+	if err != nil {
+		_ = UnwrapConn(conn).Close()
+		return nil, err
+	}
+	conn.(*Conn).epoch = s.epoch
+	return conn, nil
+}
+
+// setupConn set socket options and do TLS handshake on a new connection,
+// conn is closed if it failed.
+func (s *clusterSnapshot) setupConn(ctx context.Context, conn *Conn, addr net.Addr) error {
+	var err error
 	// SetSockOpt for tcp connection
-	switch ulconn := UnwrapConn(conn).(type) {
+	switch ulconn := socketConn(conn).(type) {
 	case *net.TCPConn:
-		if err = c.tcpsetsockopt(ulconn); err != nil {
-			ulconn.Close()
-			return nil, err
+		err = s.tcp.setsockopt(ulconn)
+		if err == nil && !s.sockopts.isZero() {
+			err = s.sockopts.setPostConnect(ulconn)
+		}
+	}
+	if err == nil && s.tls != nil {
+		var tlsConn *tls.Conn
+		tlsConn, err = s.handshake(ctx, conn._conn, addr)
+		if err == nil {
+			conn._conn = tlsConn
 		}
 	}
-	err = c.resetDeadlines(conn)
 	if err != nil {
 		_ = UnwrapConn(conn).Close()
+	}
+	return err
+}
+
+// handshake do TLS handshake on raw, stop it if ctx is done or dial timeout
+// is expired.
+func (s *clusterSnapshot) handshake(ctx context.Context, raw net.Conn, addr net.Addr) (*tls.Conn, error) {
+	conf := s.tls
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = serverName(addr)
+	}
+	tlsConn := tls.Client(raw, conf)
+	if s.dialTimeout > 0 {
+		if err := raw.SetDeadline(time.Now().Add(s.dialTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	// the watcher unblocks the handshake when ctx is done, it's joined
+	// before return so the deadline is not changed after that
+	done := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = raw.SetDeadline(time.Now())
+			canceled <- true
+		case <-done:
+			canceled <- false
+		}
+	}()
+	err := tlsConn.Handshake()
+	close(done)
+	if <-canceled {
+		return nil, ctx.Err()
+	}
+	if err != nil {
 		return nil, err
 	}
-	return conn, nil
+	return tlsConn, nil
+}
+
+// serverName return TLS server name of addr
+func serverName(addr net.Addr) string {
+	if sn, ok := addr.(ServerNamer); ok && sn.ServerName() != "" {
+		return sn.ServerName()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
 
-func (c *Cluster) resetDeadlines(conn net.Conn) error {
+func (s *clusterSnapshot) resetDeadlines(conn net.Conn) error {
 	var err error
+	if s.readTimeout == 0 && s.writeTimeout == 0 {
+		// no timeout
+		return conn.SetDeadline(time.Time{})
+	}
 	// TODO: Set REAL Deadline
-	err = conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	err = conn.SetReadDeadline(time.Now().Add(s.readTimeout))
 	if err != nil {
 		return err
 	}
-	err = conn.SetDeadline(time.Now().Add(c.ReadTimeout).Add(c.WriteTimeout))
+	err = conn.SetDeadline(time.Now().Add(s.readTimeout).Add(s.writeTimeout))
 	if err != nil {
 		return err
 	}
@@ -154,70 +752,95 @@ func (c *Cluster) resetDeadlines(conn net.Conn) error {
 
 // Close conn closer
 func (c *Cluster) Close(conn net.Conn) error {
-	if exconn, ok := conn.(*Conn); ok {
-		if exconn.err != nil {
-			return UnwrapConn(conn).Close()
-		}
+	exconn, ok := conn.(*Conn)
+	if ok && (exconn.err != nil || exconn.proxyHeader != nil) {
+		return UnwrapConn(conn).Close()
+	}
+
+	c.updateMtx.RLock()
+	defer c.updateMtx.RUnlock()
+
+	s := c.snapshot()
+	if s.connpool == nil {
+		return UnwrapConn(conn).Close()
+	}
+	if ok && exconn.epoch != s.epoch {
+		// dialed with settings before Update, incompatible with current
+		atomic.AddInt64(&c.metricInvalidated, 1)
+		return UnwrapConn(conn).Close()
 	}
-	if c.connpool != nil {
-		c.connpool.Put(conn)
+	if c.handoff(s, conn) {
 		return nil
 	}
-	return UnwrapConn(conn).Close()
+	s.connpool.Put(conn)
+	return nil
+}
+
+// modifyTCPOptions update tcp options for following dials
+func (c *Cluster) modifyTCPOptions(f func(*TCPOptions)) {
+	c.updateMtx.Lock()
+	defer c.updateMtx.Unlock()
+
+	c.snapshot()
+	c.snapMtx.Lock()
+	defer c.snapMtx.Unlock()
+	s := *c.snap.Load().(*clusterSnapshot)
+	f(&s.tcp)
+	c.snap.Store(&s)
 }
 
 // TCPSetKeepAlive change keep-alive when setsockopt after dial.
 // WARN: Keep-alive is enable by default, ensure you know what you are doing
 //       when you call this function and change it
 func (c *Cluster) TCPSetKeepAlive(keepAlive bool) {
-	c.tcpKeepAlive = keepAlive
+	c.modifyTCPOptions(func(o *TCPOptions) { o.KeepAlive = keepAlive })
 }
 
 // TCPSetKeepAlivePeriod change keep-alive period when setsockopt after dial.
 // WARN: Keep-alive period is enable 3 seconds, ensure you know what you are doing
 //       when you call this function and change it
 func (c *Cluster) TCPSetKeepAlivePeriod(d time.Duration) {
-	c.tcpKeepAlivePeriod = d
+	c.modifyTCPOptions(func(o *TCPOptions) { o.KeepAlivePeriod = d })
 }
 
 // TCPSetLinger change linger when setsockopt after dial
 // WARN: Linger is enable by default, ensure you know what you are doing
 //       when you call this function and change it
 func (c *Cluster) TCPSetLinger(linger int) {
-	c.tcpLinger = linger
+	c.modifyTCPOptions(func(o *TCPOptions) { o.Linger = linger })
 }
 
 // TCPSetNoDelay set NoDelay when setsockopt after dial
 // WARN: NoDelay is enabled by default, ensure you know what you are doing
 //       when you call this function and change it
 func (c *Cluster) TCPSetNoDelay(noDelay bool) {
-	c.tcpNoDelay = noDelay
+	c.modifyTCPOptions(func(o *TCPOptions) { o.NoDelay = noDelay })
 }
 
-// tcpsetsockopt
-func (c *Cluster) tcpsetsockopt(conn *net.TCPConn) error {
+// setsockopt set options on a tcp connection
+func (o *TCPOptions) setsockopt(conn *net.TCPConn) error {
 	var err error
 
 	// Keep-Alive
-	err = conn.SetKeepAlive(c.tcpKeepAlive)
+	err = conn.SetKeepAlive(o.KeepAlive)
 	if err != nil {
 		return err
 	}
 
 	// Keep-Alive Period
-	err = conn.SetKeepAlivePeriod(c.tcpKeepAlivePeriod)
+	err = conn.SetKeepAlivePeriod(o.KeepAlivePeriod)
 	if err != nil {
 		return err
 	}
 
 	// Linger
-	err = conn.SetLinger(c.tcpLinger)
+	err = conn.SetLinger(o.Linger)
 	if err != nil {
 		return err
 	}
 
 	// NoDelay
-	err = conn.SetNoDelay(c.tcpNoDelay)
+	err = conn.SetNoDelay(o.NoDelay)
 	if err != nil {
 		return err
 	}
@@ -226,7 +849,15 @@ func (c *Cluster) tcpsetsockopt(conn *net.TCPConn) error {
 
 func (c *Cluster) Metrics() map[string]int64 {
 	return map[string]int64{
-		"dial_direct":     atomic.LoadInt64(&c.metricDialDirect),
-		"dial_pool_reuse": atomic.LoadInt64(&c.metricDialPoolReuse),
+		"dial_direct":             atomic.LoadInt64(&c.metricDialDirect),
+		"dial_pool_reuse":         atomic.LoadInt64(&c.metricDialPoolReuse),
+		"dial_retry":              atomic.LoadInt64(&c.metricDialRetry),
+		"dial_addr_not_available": atomic.LoadInt64(&c.metricDialAddrNotAvailable),
+		"dial_egress_denied":      atomic.LoadInt64(&c.metricDialEgressDenied),
+		"dial_wait":               atomic.LoadInt64(&c.metricDialWait),
+		"dial_handoff":            atomic.LoadInt64(&c.metricDialHandoff),
+		"dial_rate_limited":       atomic.LoadInt64(&c.metricDialRateLimited),
+		"update":                  atomic.LoadInt64(&c.metricUpdate),
+		"invalidated":             atomic.LoadInt64(&c.metricInvalidated),
 	}
 }
@@ -1,7 +1,16 @@
 package exnet_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -78,8 +87,8 @@ func testCluster(t *testing.T) {
 	srvs := makeServers(t, 100)
 	cluster := exnet.NewCluster(&exnet.ClusterConfig{
 		DialTimeout:  100 * time.Millisecond,
-		ReadTimeout:  500 * time.Microsecond,
-		WriteTimeout: 500 * time.Microsecond,
+		ReadTimeout:  500 * time.Millisecond,
+		WriteTimeout: 500 * time.Millisecond,
 		PoolConfig: &exnet.ConnPoolConfig{
 			Cap: 100,
 		},
@@ -111,3 +120,254 @@ func testCluster(t *testing.T) {
 
 	t.Logf("dial metrics: %v", cluster.Metrics())
 }
+
+func TestClusterUpdate(t *testing.T) {
+	t.Run("Invalidate", testClusterUpdateInvalidate)
+	t.Run("Concurrent", testClusterUpdateConcurrent)
+	t.Run("Copy", testClusterUpdateCopy)
+	t.Run("Fields", testClusterUpdateFields)
+}
+
+func testClusterUpdateFields(t *testing.T) {
+	a1 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8001}
+	a2 := &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8002}
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{})
+	// fields set after a setter and the first use aren't lost
+	cluster.TCPSetNoDelay(false)
+	assert.Nil(t, cluster.Picker())
+	cluster.AddressPicker = addresspicker.NewRoundRobin([]net.Addr{a1})
+	cluster.ReadTimeout = time.Second
+	assert.Equal(t, a1, cluster.Picker().Addr())
+	conf := cluster.Config()
+	assert.Equal(t, time.Second, conf.ReadTimeout)
+	assert.False(t, conf.TCPOptions.NoDelay)
+
+	// ignored after Update
+	assert.NoError(t, cluster.Update(conf))
+	cluster.AddressPicker = addresspicker.NewRoundRobin([]net.Addr{a2})
+	assert.Equal(t, a1, cluster.Picker().Addr())
+}
+
+func testClusterUpdateCopy(t *testing.T) {
+	conf := &exnet.ClusterConfig{
+		PoolConfig: &exnet.ConnPoolConfig{Cap: 10},
+		Retry:      &exnet.RetryPolicy{Attempts: 2},
+		SourceAddr: &exnet.SourceAddrConfig{IPs: []net.IP{net.IPv4(127, 0, 0, 1)}},
+		TLSConfig:  &tls.Config{ServerName: "localhost"},
+	}
+	cluster := exnet.NewCluster(conf)
+	conf.PoolConfig.Cap = 1
+	conf.TLSConfig.ServerName = "example.com"
+
+	// changes of the config returned take effect by Update only
+	got := cluster.Config()
+	assert.Equal(t, 10, got.PoolConfig.Cap)
+	assert.Equal(t, "localhost", got.TLSConfig.ServerName)
+	got.PoolConfig.Cap = 1
+	got.Retry.Attempts = 5
+	got.SourceAddr.IPs[0][3] = 2
+	got.TLSConfig.ServerName = "example.com"
+	got = cluster.Config()
+	assert.Equal(t, 10, got.PoolConfig.Cap)
+	assert.Equal(t, 2, got.Retry.Attempts)
+	assert.Equal(t, "127.0.0.1", got.SourceAddr.IPs[0].String())
+	assert.Equal(t, "localhost", got.TLSConfig.ServerName)
+
+	// the same settings are compatible even though they're copied
+	closed := make(chan struct{}, 1)
+	assert.NoError(t, cluster.Close(exnet.WithConn(&testConn{close: func() error {
+		closed <- struct{}{}
+		return nil
+	}})))
+	got.InvalidateIncompatible = true
+	assert.NoError(t, cluster.Update(got))
+	assert.Len(t, closed, 0)
+	assert.Equal(t, int64(0), cluster.Metrics()["invalidated"])
+
+	got.TLSConfig.ServerName = "example.com"
+	assert.NoError(t, cluster.Update(got))
+	assert.Len(t, closed, 1)
+	assert.Equal(t, int64(1), cluster.Metrics()["invalidated"])
+}
+
+func testClusterUpdateInvalidate(t *testing.T) {
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:  100 * time.Millisecond,
+		ReadTimeout:  500 * time.Millisecond,
+		WriteTimeout: 500 * time.Millisecond,
+		PoolConfig: &exnet.ConnPoolConfig{
+			Cap: 10,
+		},
+	})
+	closed := make(chan int, 2)
+	newConn := func(id int) net.Conn {
+		return exnet.WithConn(&testConn{close: func() error {
+			closed <- id
+			return nil
+		}})
+	}
+	assert.NoError(t, cluster.Close(newConn(1)))
+	conn, err := cluster.Dial("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_pool_reuse"])
+	assert.NoError(t, cluster.Close(newConn(2)))
+
+	// compatible update keeps pooled connections
+	conf := cluster.Config()
+	conf.ReadTimeout = time.Second
+	assert.NoError(t, cluster.Update(conf))
+	assert.Equal(t, time.Second, cluster.Config().ReadTimeout)
+	assert.Len(t, closed, 0)
+
+	// incompatible update closes pooled and in-use connections
+	conf.TCPOptions.NoDelay = false
+	conf.InvalidateIncompatible = true
+	assert.NoError(t, cluster.Update(conf))
+	assert.Equal(t, 2, <-closed)
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, 1, <-closed)
+	assert.Equal(t, int64(2), cluster.Metrics()["invalidated"])
+	assert.False(t, cluster.Config().TCPOptions.NoDelay)
+}
+
+func testClusterUpdateConcurrent(t *testing.T) {
+	srvs := makeServers(t, 2)
+	ap := addresspicker.NewRoundRobin(nil)
+	for _, s := range srvs {
+		assert.NoError(t, ap.AppendTCPAddress("tcp", s.listener.Addr().String()))
+	}
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:   time.Second,
+		ReadTimeout:   time.Second,
+		WriteTimeout:  time.Second,
+		AddressPicker: ap,
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			conf := cluster.Config()
+			conf.DialTimeout = time.Duration(i+1) * time.Second
+			conf.PoolConfig = &exnet.ConnPoolConfig{Cap: i%5 + 1}
+			assert.NoError(t, cluster.Update(conf))
+			cluster.TCPSetNoDelay(i%2 == 0)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		conn, err := cluster.Dial("", "")
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, err = conn.Write(cmsg)
+		assert.NoError(t, err)
+		buf := make([]byte, len(smsg))
+		_, err = conn.Read(buf)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+	}
+	<-done
+	assert.Equal(t, int64(50), cluster.Metrics()["update"])
+}
+
+// testCertificate create a self-signed certificate for localhost
+func testCertificate(t *testing.T, cn string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+type testConcern struct {
+	*addresspicker.RoundRobin
+	failures int32
+}
+
+func (c *testConcern) Connected(net.Addr)    {}
+func (c *testConcern) Disconnected(net.Addr) {}
+func (c *testConcern) Failure(net.Addr, error) {
+	atomic.AddInt32(&c.failures, 1)
+}
+
+func TestClusterTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "server")
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, len(cmsg))
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					_, _ = conn.Write(smsg)
+				}
+			}()
+		}
+	}()
+
+	ap := &testConcern{RoundRobin: addresspicker.NewRoundRobin(nil)}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	assert.NoError(t, ap.AppendTCPAddress("tcp", net.JoinHostPort("localhost", port)))
+	tlsConf := &tls.Config{RootCAs: pool}
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:   time.Second,
+		ReadTimeout:   time.Second,
+		WriteTimeout:  time.Second,
+		AddressPicker: ap,
+		TLSConfig:     tlsConf,
+		PoolConfig:    &exnet.ConnPoolConfig{Cap: 1},
+	})
+
+	for i := 0; i < 2; i++ {
+		conn, err := cluster.Dial("", "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		tlsConn, ok := exnet.UnwrapConn(conn).(*tls.Conn)
+		assert.True(t, ok, "pooled connection must keep its TLS state")
+		state := tlsConn.ConnectionState()
+		assert.Equal(t, "localhost", state.ServerName)
+		_, err = conn.Write(cmsg)
+		assert.NoError(t, err)
+		buf := make([]byte, len(smsg))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, smsg, buf)
+		// the session of first dial is resumed by the second one
+		assert.Equal(t, i == 1, state.DidResume)
+		assert.NoError(t, conn.Close())
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&ap.failures))
+
+	// handshake failures count as dial failures
+	conf := cluster.Config()
+	conf.TLSConfig = &tls.Config{}
+	assert.NoError(t, cluster.Update(conf))
+	_, err = cluster.Dial("", "")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ap.failures))
+}
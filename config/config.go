@@ -0,0 +1,156 @@
+// Package config loads exnet clusters from JSON or YAML files, e.g.
+//
+//	clusters:
+//	  echo:
+//	    dial_timeout: 100ms
+//	    read_timeout: 500ms
+//	    write_timeout: 500ms
+//	    balancer: weighted_round_robin
+//	    addresses:
+//	      - address: 192.168.0.1:8756
+//	        weight: 10
+//	      - address: 192.168.0.2:8756
+//	        weight: 20
+//	    pool:
+//	      cap: 100
+//	      async: true
+//	    tcp:
+//	      keep_alive_period: 10s
+//	      no_delay: true
+//	    retry:
+//	      attempts: 3
+//	      backoff: 10ms
+//	    breaker:
+//	      failures: 5
+//	      cooldown: 10s
+//
+// Omitted fields take defaults, invalid fields are reported with their path.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eddix/exnet/discovery"
+)
+
+// Balancer names
+const (
+	RoundRobin         = "round_robin"
+	WeightedRoundRobin = "weighted_round_robin"
+)
+
+// Defaults applied to omitted fields
+const (
+	DefaultDialTimeout  = time.Second
+	DefaultReadTimeout  = time.Second
+	DefaultWriteTimeout = time.Second
+	DefaultBalancer     = RoundRobin
+	DefaultPoolCap      = 64
+	DefaultRetryBackoff = 0
+	DefaultBreakerFails = 5
+	DefaultBreakerCool  = 10 * time.Second
+)
+
+// Config is the root of a config file
+type Config struct {
+	Clusters map[string]*Cluster `json:"clusters" yaml:"clusters"`
+}
+
+// Cluster is the config of an exnet.Cluster
+type Cluster struct {
+	DialTimeout  *Duration                `json:"dial_timeout" yaml:"dial_timeout"`
+	ReadTimeout  *Duration                `json:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout *Duration                `json:"write_timeout" yaml:"write_timeout"`
+	Balancer     string                   `json:"balancer" yaml:"balancer"`
+	Addresses    []discovery.EndpointSpec `json:"addresses" yaml:"addresses"`
+	Pool         *Pool                    `json:"pool" yaml:"pool"`
+	TCP          *TCP                     `json:"tcp" yaml:"tcp"`
+	Retry        *Retry                   `json:"retry" yaml:"retry"`
+	Breaker      *Breaker                 `json:"breaker" yaml:"breaker"`
+}
+
+// Pool is the config of connection pool, omit it to disable pooling
+type Pool struct {
+	Cap   *int `json:"cap" yaml:"cap"`
+	Async bool `json:"async" yaml:"async"`
+}
+
+// TCP is socket options of dialed tcp connections
+type TCP struct {
+	KeepAlive       *bool     `json:"keep_alive" yaml:"keep_alive"`
+	KeepAlivePeriod *Duration `json:"keep_alive_period" yaml:"keep_alive_period"`
+	Linger          *int      `json:"linger" yaml:"linger"`
+	NoDelay         *bool     `json:"no_delay" yaml:"no_delay"`
+}
+
+// Retry is the config of exnet.RetryPolicy
+type Retry struct {
+	Attempts *int      `json:"attempts" yaml:"attempts"`
+	Backoff  *Duration `json:"backoff" yaml:"backoff"`
+}
+
+// Breaker is the config of addresspicker.Breaker
+type Breaker struct {
+	Failures *int      `json:"failures" yaml:"failures"`
+	Cooldown *Duration `json:"cooldown" yaml:"cooldown"`
+}
+
+// Duration is a time.Duration written as string like "100ms"
+type Duration time.Duration
+
+// Std return d as time.Duration
+func (d *Duration) Std() time.Duration {
+	if d == nil {
+		return 0
+	}
+	return time.Duration(*d)
+}
+
+// UnmarshalJSON parse duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string like \"100ms\"")
+	}
+	return d.parse(s)
+}
+
+// UnmarshalYAML parse duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return errors.New("duration must be a string like \"100ms\"")
+	}
+	return d.parse(s)
+}
+
+// MarshalJSON format duration as string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// MarshalYAML format duration as string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func durationOf(v time.Duration) *Duration {
+	d := Duration(v)
+	return &d
+}
+
+func intOf(v int) *int {
+	return &v
+}
@@ -0,0 +1,314 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+// Format of config data
+type Format int
+
+// Formats
+const (
+	JSON Format = iota
+	YAML
+)
+
+// FieldError is an invalid field in config
+type FieldError struct {
+	// Field is the path of the field, e.g. "clusters.echo.read_timeout"
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+// Unwrap return the underlying error
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Errors is all invalid fields in config
+type Errors []*FieldError
+
+func (es Errors) Error() string {
+	msgs := make([]string, 0, len(es))
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return "config: " + strings.Join(msgs, "; ")
+}
+
+// Load read config file, format is detected by extension, ".yaml" and
+// ".yml" are YAML, others are JSON.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := JSON
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = YAML
+	}
+	return Parse(b, format)
+}
+
+// Parse config data, apply defaults and validate it
+func Parse(b []byte, format Format) (*Config, error) {
+	conf := &Config{}
+	var err error
+	switch format {
+	case YAML:
+		err = yaml.UnmarshalStrict(b, conf)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(conf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	conf.SetDefaults()
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// SetDefaults fill omitted fields with defaults
+func (conf *Config) SetDefaults() {
+	for _, c := range conf.Clusters {
+		if c != nil {
+			c.SetDefaults()
+		}
+	}
+}
+
+// Validate config, return Errors if any field is invalid
+func (conf *Config) Validate() error {
+	var errs Errors
+	for _, name := range conf.names() {
+		c := conf.Clusters[name]
+		if c == nil {
+			errs = append(errs, &FieldError{"clusters." + name, errors.New("is empty")})
+			continue
+		}
+		errs = append(errs, c.validate("clusters."+name)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Build all clusters and register them into a ClusterManager by name,
+// omitted fields are filled with defaults, and Errors is returned if the
+// config is invalid.
+func (conf *Config) Build(fallback *exnet.Dialer) (*exnet.ClusterManager, error) {
+	conf.SetDefaults()
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	m := exnet.NewClusterManager(fallback)
+	for _, name := range conf.names() {
+		c, err := conf.Clusters[name].build()
+		if err != nil {
+			return nil, &FieldError{"clusters." + name, err}
+		}
+		m.Register(name, c)
+	}
+	return m, nil
+}
+
+func (conf *Config) names() []string {
+	names := make([]string, 0, len(conf.Clusters))
+	for name := range conf.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetDefaults fill omitted fields with defaults
+func (c *Cluster) SetDefaults() {
+	if c.DialTimeout == nil {
+		c.DialTimeout = durationOf(DefaultDialTimeout)
+	}
+	if c.ReadTimeout == nil {
+		c.ReadTimeout = durationOf(DefaultReadTimeout)
+	}
+	if c.WriteTimeout == nil {
+		c.WriteTimeout = durationOf(DefaultWriteTimeout)
+	}
+	if c.Balancer == "" {
+		c.Balancer = DefaultBalancer
+	}
+	if c.Pool != nil && c.Pool.Cap == nil {
+		c.Pool.Cap = intOf(DefaultPoolCap)
+	}
+	if c.Retry != nil {
+		if c.Retry.Attempts == nil {
+			c.Retry.Attempts = intOf(1)
+		}
+		if c.Retry.Backoff == nil {
+			c.Retry.Backoff = durationOf(DefaultRetryBackoff)
+		}
+	}
+	if c.Breaker != nil {
+		if c.Breaker.Failures == nil {
+			c.Breaker.Failures = intOf(DefaultBreakerFails)
+		}
+		if c.Breaker.Cooldown == nil {
+			c.Breaker.Cooldown = durationOf(DefaultBreakerCool)
+		}
+	}
+}
+
+func (c *Cluster) validate(path string) Errors {
+	var errs Errors
+	check := func(field string, err error) {
+		if err != nil {
+			if path != "" {
+				field = path + "." + field
+			}
+			errs = append(errs, &FieldError{field, err})
+		}
+	}
+	check("dial_timeout", positive(c.DialTimeout))
+	check("read_timeout", positive(c.ReadTimeout))
+	check("write_timeout", positive(c.WriteTimeout))
+	switch c.Balancer {
+	case RoundRobin, WeightedRoundRobin:
+	default:
+		check("balancer", fmt.Errorf("unknown balancer %q, should be %q or %q",
+			c.Balancer, RoundRobin, WeightedRoundRobin))
+	}
+	if len(c.Addresses) == 0 {
+		check("addresses", errors.New("is empty"))
+	}
+	for i := range c.Addresses {
+		_, err := c.Addresses[i].Endpoint()
+		check(fmt.Sprintf("addresses[%d]", i), err)
+	}
+	if c.Pool != nil && c.Pool.Cap != nil && *c.Pool.Cap <= 0 {
+		check("pool.cap", errors.New("must be positive"))
+	}
+	if c.TCP != nil {
+		if c.TCP.KeepAlivePeriod != nil {
+			check("tcp.keep_alive_period", positive(c.TCP.KeepAlivePeriod))
+		}
+		if c.TCP.Linger != nil && *c.TCP.Linger < -1 {
+			check("tcp.linger", errors.New("must be -1 or greater"))
+		}
+	}
+	if c.Retry != nil {
+		if c.Retry.Attempts != nil && *c.Retry.Attempts < 1 {
+			check("retry.attempts", errors.New("must be at least 1"))
+		}
+		if c.Retry.Backoff.Std() < 0 {
+			check("retry.backoff", errors.New("must not be negative"))
+		}
+	}
+	if c.Breaker != nil {
+		if c.Breaker.Failures != nil && *c.Breaker.Failures < 1 {
+			check("breaker.failures", errors.New("must be at least 1"))
+		}
+		if c.Breaker.Cooldown != nil {
+			check("breaker.cooldown", positive(c.Breaker.Cooldown))
+		}
+	}
+	return errs
+}
+
+// Build an exnet.Cluster, omitted fields are filled with defaults, and
+// Errors is returned if the config is invalid.
+func (c *Cluster) Build() (*exnet.Cluster, error) {
+	c.SetDefaults()
+	if errs := c.validate(""); len(errs) > 0 {
+		return nil, errs
+	}
+	return c.build()
+}
+
+func (c *Cluster) build() (*exnet.Cluster, error) {
+	endpoints := make([]addresspicker.Endpoint, 0, len(c.Addresses))
+	for i := range c.Addresses {
+		ep, err := c.Addresses[i].Endpoint()
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, ep)
+	}
+	var ap interface {
+		exnet.AddressPicker
+		addresspicker.Updater
+	}
+	switch c.Balancer {
+	case WeightedRoundRobin:
+		ap = addresspicker.NewWeightedRoundRobin(endpoints)
+	default:
+		ap = addresspicker.NewRoundRobin(addresspicker.Addrs(endpoints))
+	}
+	if c.Breaker != nil {
+		ap = addresspicker.NewUpdatableBreaker(ap, &addresspicker.BreakerConfig{
+			Failures: *c.Breaker.Failures,
+			Cooldown: c.Breaker.Cooldown.Std(),
+		})
+	}
+
+	conf := &exnet.ClusterConfig{
+		DialTimeout:   c.DialTimeout.Std(),
+		ReadTimeout:   c.ReadTimeout.Std(),
+		WriteTimeout:  c.WriteTimeout.Std(),
+		AddressPicker: ap,
+	}
+	if c.Pool != nil {
+		conf.PoolConfig = &exnet.ConnPoolConfig{Cap: *c.Pool.Cap}
+		conf.UseAsyncPool = c.Pool.Async
+	}
+	if c.Retry != nil {
+		conf.Retry = &exnet.RetryPolicy{
+			Attempts: *c.Retry.Attempts,
+			Backoff:  c.Retry.Backoff.Std(),
+		}
+	}
+	if c.TCP != nil {
+		opts := exnet.DefaultTCPOptions()
+		if c.TCP.KeepAlive != nil {
+			opts.KeepAlive = *c.TCP.KeepAlive
+		}
+		if c.TCP.KeepAlivePeriod != nil {
+			opts.KeepAlivePeriod = c.TCP.KeepAlivePeriod.Std()
+		}
+		if c.TCP.Linger != nil {
+			opts.Linger = *c.TCP.Linger
+		}
+		if c.TCP.NoDelay != nil {
+			opts.NoDelay = *c.TCP.NoDelay
+		}
+		conf.TCPOptions = opts
+	}
+	cluster := exnet.NewCluster(conf)
+	return cluster, nil
+}
+
+func positive(d *Duration) error {
+	if d.Std() <= 0 {
+		return errors.New("must be positive")
+	}
+	return nil
+}
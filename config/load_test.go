@@ -0,0 +1,188 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet/config"
+	"github.com/eddix/exnet/discovery"
+)
+
+func TestParse(t *testing.T) {
+	yamlConf := `
+clusters:
+  echo:
+    dial_timeout: 100ms
+    balancer: weighted_round_robin
+    addresses:
+      - address: 127.0.0.1:8001
+        weight: 10
+      - address: 127.0.0.1:8002
+    pool:
+      async: true
+    tcp:
+      keep_alive_period: 10s
+    retry:
+      attempts: 3
+    breaker: {}
+`
+	jsonConf := `{
+  "clusters": {
+    "echo": {
+      "dial_timeout": "100ms",
+      "balancer": "weighted_round_robin",
+      "addresses": [
+        {"address": "127.0.0.1:8001", "weight": 10},
+        {"address": "127.0.0.1:8002"}
+      ],
+      "pool": {"async": true},
+      "tcp": {"keep_alive_period": "10s"},
+      "retry": {"attempts": 3},
+      "breaker": {}
+    }
+  }
+}`
+	for format, data := range map[config.Format]string{config.YAML: yamlConf, config.JSON: jsonConf} {
+		conf, err := config.Parse([]byte(data), format)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		c := conf.Clusters["echo"]
+		assert.Equal(t, 100*time.Millisecond, c.DialTimeout.Std())
+		assert.Equal(t, config.DefaultReadTimeout, c.ReadTimeout.Std())
+		assert.Equal(t, config.DefaultWriteTimeout, c.WriteTimeout.Std())
+		assert.Equal(t, config.WeightedRoundRobin, c.Balancer)
+		assert.Len(t, c.Addresses, 2)
+		assert.Equal(t, config.DefaultPoolCap, *c.Pool.Cap)
+		assert.True(t, c.Pool.Async)
+		assert.Equal(t, 10*time.Second, c.TCP.KeepAlivePeriod.Std())
+		assert.Nil(t, c.TCP.NoDelay)
+		assert.Equal(t, 3, *c.Retry.Attempts)
+		assert.Equal(t, time.Duration(0), c.Retry.Backoff.Std())
+		assert.Equal(t, config.DefaultBreakerFails, *c.Breaker.Failures)
+		assert.Equal(t, config.DefaultBreakerCool, c.Breaker.Cooldown.Std())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, err := config.Parse([]byte(`
+clusters:
+  echo:
+    read_timeout: 0s
+    balancer: random
+    addresses:
+      - address: 127.0.0.1:8001
+      - address: "not an address"
+    pool:
+      cap: 0
+    retry:
+      attempts: 0
+  empty:
+    addresses: []
+`), config.YAML)
+	errs, ok := err.(config.Errors)
+	if !assert.True(t, ok, "%v", err) {
+		return
+	}
+	var fields []string
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{
+		"clusters.echo.read_timeout",
+		"clusters.echo.balancer",
+		"clusters.echo.addresses[1]",
+		"clusters.echo.pool.cap",
+		"clusters.echo.retry.attempts",
+		"clusters.empty.addresses",
+	}, fields)
+
+	// malformed values and unknown fields are rejected
+	_, err = config.Parse([]byte(`{"clusters": {"echo": {"dial_timeout": 100}}}`), config.JSON)
+	assert.Error(t, err)
+	_, err = config.Parse([]byte(`{"clusters": {"echo": {"dial_timeuot": "1s"}}}`), config.JSON)
+	assert.Error(t, err)
+}
+
+func TestLoadAndBuild(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	dir, err := ioutil.TempDir("", "exnet-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clusters.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+clusters:
+  echo:
+    addresses:
+      - address: 127.0.0.1:1
+      - address: `+lis.Addr().String()+`
+    retry:
+      attempts: 2
+    tcp:
+      no_delay: false
+`), 0644))
+
+	conf, err := config.Load(path)
+	assert.NoError(t, err)
+	manager, err := conf.Build(nil)
+	assert.NoError(t, err)
+	cluster, ok := manager.Cluster("echo")
+	assert.True(t, ok)
+
+	// the first address is refused, retry picks the next one
+	conn, err := manager.Dial("tcp", "echo:80")
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.NoError(t, conn.Close())
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_retry"])
+}
+
+func TestBuildWithoutParse(t *testing.T) {
+	// omitted fields are filled by Build
+	c := &config.Cluster{
+		Addresses: []discovery.EndpointSpec{{Address: "127.0.0.1:8001"}},
+		Pool:      &config.Pool{},
+		Retry:     &config.Retry{},
+		Breaker:   &config.Breaker{},
+	}
+	cluster, err := c.Build()
+	assert.NoError(t, err)
+	assert.NotNil(t, cluster)
+	assert.Equal(t, config.DefaultBreakerFails, *c.Breaker.Failures)
+
+	c.Addresses = nil
+	_, err = c.Build()
+	if assert.IsType(t, config.Errors{}, err) {
+		assert.Equal(t, "addresses", err.(config.Errors)[0].Field)
+	}
+
+	conf := &config.Config{Clusters: map[string]*config.Cluster{"echo": c}}
+	_, err = conf.Build(nil)
+	if assert.IsType(t, config.Errors{}, err) {
+		assert.Equal(t, "clusters.echo.addresses", err.(config.Errors)[0].Field)
+	}
+}
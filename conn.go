@@ -1,6 +1,7 @@
 package exnet
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"time"
@@ -19,6 +20,12 @@ type Conn struct {
 	closer ConnCloser
 	// err
 	err error
+	// epoch of Cluster config when the connection is dialed
+	epoch uint64
+	// proxyHeader is the PROXY header received or sent on the connection
+	proxyHeader *ProxyHeader
+	// timeouts policies from Listener
+	timeouts *connTimeouts
 }
 
 // ConnCloser is close delegate
@@ -43,6 +50,10 @@ func (c *Conn) Underlying() net.Conn {
 // Read can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
 func (c *Conn) Read(b []byte) (n int, err error) {
+	if c.timeouts != nil {
+		c.timeouts.beginRead(c._conn)
+		defer func() { c.timeouts.endRead(c._conn, n > 0) }()
+	}
 	n, err = c._conn.Read(b)
 	// trace
 	if tracer, ok := c.tracer.(ReadTracer); ok {
@@ -56,6 +67,10 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 // Write can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
 func (c *Conn) Write(b []byte) (n int, err error) {
+	if c.timeouts != nil {
+		c.timeouts.beginWrite(c._conn)
+		defer func() { c.timeouts.endWrite(c._conn, n > 0) }()
+	}
 	n, err = c._conn.Write(b)
 	// trace
 	if tracer, ok := c.tracer.(WriteTracer); ok {
@@ -125,7 +140,14 @@ func (c *Conn) SetDeadline(t time.Time) error {
 		}
 		return nil
 	}
-	err := c._conn.SetDeadline(t)
+	var err error
+	if c.timeouts != nil {
+		if err = c.timeouts.setReadDeadline(c._conn, t); err == nil {
+			err = c.timeouts.setWriteDeadline(c._conn, t)
+		}
+	} else {
+		err = c._conn.SetDeadline(t)
+	}
 	if tracer, ok := c.tracer.(SetDeadlineTracer); ok {
 		tracer.TraceSetDeadline(c, t, err)
 	}
@@ -142,7 +164,12 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 		}
 		return nil
 	}
-	err := c._conn.SetReadDeadline(t)
+	var err error
+	if c.timeouts != nil {
+		err = c.timeouts.setReadDeadline(c._conn, t)
+	} else {
+		err = c._conn.SetReadDeadline(t)
+	}
 	if tracer, ok := c.tracer.(SetReadDeadlineTracer); ok {
 		tracer.TraceSetReadDeadline(c, t, err)
 	}
@@ -161,7 +188,12 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 		}
 		return nil
 	}
-	err := c._conn.SetWriteDeadline(t)
+	var err error
+	if c.timeouts != nil {
+		err = c.timeouts.setWriteDeadline(c._conn, t)
+	} else {
+		err = c._conn.SetWriteDeadline(t)
+	}
 	if tracer, ok := c.tracer.(SetWriteDeadlineTracer); ok {
 		tracer.TraceSetWriteDeadline(c, t, err)
 	}
@@ -187,6 +219,31 @@ func UnwrapConn(conn net.Conn) net.Conn {
 	return uc
 }
 
+// socketConn return the connection of the socket under conn, through
+// wrappers, proxies, replayed bytes and TLS, e.g. to set socket options.
+// Unlike UnwrapConn, the connection returned can't be read or written in
+// place of conn.
+func socketConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case connWrapper:
+			conn = c.Underlying()
+		case *proxiedConn:
+			conn = c.Conn
+		case *replayConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		case *tls.Conn:
+			if conn = tlsNetConn(c); conn == nil {
+				return c
+			}
+		default:
+			return conn
+		}
+	}
+}
+
 // Freeze changes of deadlines, call SetDeadline, SetReadDeadline, or SetWriteDeadline
 // will do nothing on a freezed exnet.Conn, unless use Unfreeze() on the exnet.Conn
 func Freeze(conn net.Conn) error {
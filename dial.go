@@ -4,11 +4,22 @@ import (
 	"context"
 	"net"
 	"time"
+
+	"github.com/eddix/exnet/addresspicker"
 )
 
+const defaultFallbackDelay = 250 * time.Millisecond
+
 // Dialer to dial and return an exnet.Conn
 type Dialer struct {
-	dialer *net.Dialer
+	dialer   *net.Dialer
+	sockopts *SocketOptions
+	source   *sourceAddrs
+	resolver Resolver
+	family   *addresspicker.FamilyConfig
+	stats    *addresspicker.FamilyStats
+	proxy    *ProxyConfig
+	egress   *EgressPolicy
 }
 
 // Dial works like net.Dial but return an exnet.Conn
@@ -28,19 +39,260 @@ func (d *Dialer) Underlying() *net.Dialer {
 	return d.dialer
 }
 
+// SetSocketOptions set o on every dialed tcp connection, nil removes them
+func (d *Dialer) SetSocketOptions(o *SocketOptions) {
+	d.sockopts = o
+}
+
+// SetResolver resolve host names by r, e.g. a DNSCache, the addresses are
+// dialed in order until one succeeds. nil means the resolver of the
+// underlying net.Dialer.
+func (d *Dialer) SetResolver(r Resolver) {
+	d.resolver = r
+}
+
+// SetFamilyPolicy order and filter resolved addresses of host names by IP
+// family, dial results are counted by family, see FamilyMetrics. nil
+// removes it.
+func (d *Dialer) SetFamilyPolicy(conf *addresspicker.FamilyConfig) {
+	d.family = conf
+	d.stats = nil
+	if conf != nil {
+		d.stats = addresspicker.NewFamilyStats(conf)
+	}
+}
+
+// FamilyMetrics return dial results by IP family, nil if there is no
+// family policy.
+func (d *Dialer) FamilyMetrics() map[string]int64 {
+	if d.stats == nil {
+		return nil
+	}
+	return d.stats.Metrics()
+}
+
 // Dial without context
 func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, address)
 }
 
-// DialContext dial with context
+// DialContext dial with context, if ctx is from WithProxyHeader, the
+// PROXY header is sent on the connection. EADDRNOTAVAIL is returned as
+// AddrNotAvailableError, and dials denied by the egress policy as
+// EgressError.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	if d.dialer == nil {
-		d.dialer = &net.Dialer{}
+	// don't write d, it may be shared by goroutines
+	dialer := d.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
 	}
-	conn, err := d.dialer.DialContext(ctx, network, address)
+	if !d.sockopts.isZero() || d.source != nil || d.egress != nil {
+		nd := *dialer
+		if !d.sockopts.isZero() {
+			nd.Control = d.sockopts.control(nd.Control)
+		}
+		if d.source != nil {
+			nd.Control = d.source.control(nd.Control)
+		}
+		if d.egress != nil {
+			// outermost, so it's checked before the socket is touched by
+			// other options
+			nd.Control = d.egress.control(nd.Control)
+		}
+		dialer = &nd
+	}
+	var conn net.Conn
+	var err error
+	switch {
+	case d.proxy != nil:
+		conn, err = d.dialProxy(ctx, dialer, network, address)
+	case d.resolver != nil || d.family != nil:
+		conn, err = d.dialResolved(ctx, dialer, network, address)
+	default:
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, egressDenied(addrNotAvailable(network, address, err))
+	}
+	if tc, ok := socketConn(conn).(*net.TCPConn); ok && !d.sockopts.isZero() {
+		if err = d.sockopts.setPostConnect(tc); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	c := &Conn{_conn: conn}
+	if h := proxyHeaderFromContext(ctx); h != nil {
+		if _, err = h.WriteTo(conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		c.proxyHeader = h
+	}
+	return c, nil
+}
+
+// dialResolved resolve host of address by the resolver of d, and dial the
+// addresses in order of the family policy.
+func (d *Dialer) dialResolved(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || net.ParseIP(host) != nil || !ipNetwork(network) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	if dialer.Timeout > 0 {
+		// the timeout is for all addresses, including resolving
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+	var resolver Resolver = net.DefaultResolver
+	if d.resolver != nil {
+		resolver = d.resolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return nil, err
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	addrs = filterFamily(network, addrs)
+	if d.family != nil {
+		addrs = d.stats.Filter(d.family.Policy.Order(addrs))
+	}
+	if len(addrs) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+	if d.family != nil && d.family.Policy == addresspicker.HappyEyeballs {
+		delay := d.family.FallbackDelay
+		if delay <= 0 {
+			delay = defaultFallbackDelay
+		}
+		return d.dialParallel(ctx, dialer, network, port, addrs, delay)
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		d.attempt(addr)
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		d.count(ctx, addr, err)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialParallel dial addrs in order, the next address is dialed if the
+// previous fails or doesn't connect in delay, while the previous ones keep
+// dialing. The first connection wins, see RFC 8305.
+func (d *Dialer) dialParallel(ctx context.Context, dialer *net.Dialer, network, port string, addrs []net.IPAddr, delay time.Duration) (net.Conn, error) {
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		d.attempt(addr)
+		go func() {
+			conn, err := dialer.DialContext(dialCtx, network, net.JoinHostPort(addr.String(), port))
+			d.count(dialCtx, addr, err)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if next < len(addrs) {
+			timer = time.NewTimer(delay)
+			fallback = timer.C
+		}
+		var r *dialResult
+		select {
+		case result := <-results:
+			r = &result
+		case <-fallback:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if r == nil {
+			start()
+			continue
+		}
+		pending--
+		if r.err == nil {
+			cancel()
+			// close connections of the losers
+			go func(n int) {
+				for ; n > 0; n-- {
+					if r := <-results; r.conn != nil {
+						_ = r.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		if next < len(addrs) {
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// attempt take the probe of the family of addr if it's broken
+func (d *Dialer) attempt(addr net.IPAddr) {
+	if d.stats != nil {
+		d.stats.Attempt(addr.IP)
+	}
+}
+
+// count a dial result by family, dials canceled are not counted
+func (d *Dialer) count(ctx context.Context, addr net.IPAddr, err error) {
+	if d.stats == nil {
+		return
+	}
+	if err == nil {
+		d.stats.Success(addr.IP)
+	} else if ctx.Err() == nil {
+		d.stats.Failure(addr.IP)
+	}
+}
+
+func ipNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// filterFamily return addresses can be dialed on network, e.g. IPv4 ones for
+// tcp4
+func filterFamily(network string, addrs []net.IPAddr) []net.IPAddr {
+	last := network[len(network)-1]
+	if last != '4' && last != '6' {
+		return addrs
+	}
+	filtered := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (last == '4') {
+			filtered = append(filtered, addr)
+		}
 	}
-	return &Conn{_conn: conn}, nil
+	return filtered
 }
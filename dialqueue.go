@@ -0,0 +1,165 @@
+package exnet
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// dialGate bounds dials in progress to an address of Cluster, callers more
+// than the dials wait in FIFO order for their results, or for connections
+// returned by Cluster.Close.
+type dialGate struct {
+	inflight int
+	waiters  []*dialWaiter
+}
+
+// dialWaiter is a caller waiting for a connection, result receives exactly
+// one result once the waiter is removed from its gate.
+type dialWaiter struct {
+	result chan dialResult
+}
+
+// dialQueued dial addr in background if it has less than MaxDialsPerAddr
+// dials in progress, and wait for a connection dialed to addr, or returned
+// to the cluster, whichever comes first.
+func (c *Cluster) dialQueued(ctx context.Context, s *clusterSnapshot, addr net.Addr) (net.Conn, error) {
+	w := &dialWaiter{result: make(chan dialResult, 1)}
+
+	c.gatesMtx.Lock()
+	if c.gates == nil {
+		c.gates = make(map[string]*dialGate)
+	}
+	g := c.gates[gateKey(addr)]
+	if g == nil {
+		g = &dialGate{}
+		c.gates[gateKey(addr)] = g
+	}
+	g.waiters = append(g.waiters, w)
+	if !c.startDial(s, g, addr) {
+		atomic.AddInt64(&c.metricDialWait, 1)
+	}
+	c.gatesMtx.Unlock()
+
+	var r dialResult
+	select {
+	case r = <-w.result:
+	case <-ctx.Done():
+		c.gatesMtx.Lock()
+		removed := g.remove(w)
+		c.gc(addr, g)
+		c.gatesMtx.Unlock()
+		if removed {
+			return nil, ctx.Err()
+		}
+		// the result is sent before the waiter is removed, give it to
+		// others
+		if r = <-w.result; r.conn != nil {
+			_ = c.Close(r.conn)
+		}
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := s.resetDeadlines(r.conn); err != nil {
+		_ = UnwrapConn(r.conn).Close()
+		return nil, err
+	}
+	return r.conn, nil
+}
+
+// startDial start a dial to addr in background if g has more waiters than
+// dials in progress, and less dials than MaxDialsPerAddr, which is unbound
+// if it's updated to 0. The caller must hold gatesMtx.
+func (c *Cluster) startDial(s *clusterSnapshot, g *dialGate, addr net.Addr) bool {
+	if len(g.waiters) <= g.inflight || (s.maxDials > 0 && g.inflight >= s.maxDials) {
+		return false
+	}
+	g.inflight++
+	go func() {
+		// not canceled with the caller, the connection is handed to the
+		// next waiter or put into pool
+		conn, err := c.dialAddr(context.Background(), s, addr)
+		c.finishDial(addr, g, dialResult{conn: conn, err: err})
+	}()
+	return true
+}
+
+// finishDial hand the result of a dial to the first waiter of g, the
+// connection is returned to cluster if there is none.
+func (c *Cluster) finishDial(addr net.Addr, g *dialGate, r dialResult) {
+	c.gatesMtx.Lock()
+	g.inflight--
+	var w *dialWaiter
+	if len(g.waiters) > 0 {
+		w = g.waiters[0]
+		g.waiters = g.waiters[1:]
+		w.result <- r
+	}
+	// waiters left, e.g. the dial failed, need dials of their own, the
+	// settings may be updated since the dial started
+	c.startDial(c.snapshot(), g, addr)
+	c.gc(addr, g)
+	c.gatesMtx.Unlock()
+
+	if w == nil && r.conn != nil {
+		_ = c.Close(r.conn)
+	}
+}
+
+// handoff give conn to a waiter of its address, or of any address if there
+// is none, return false if nobody is waiting. Only the exnet.Conn is
+// replaced, so a proxied connection keeps its target and the data not read
+// yet.
+func (c *Cluster) handoff(s *clusterSnapshot, conn net.Conn) bool {
+	c.gatesMtx.Lock()
+	defer c.gatesMtx.Unlock()
+	var g *dialGate
+	if addr := conn.RemoteAddr(); addr != nil {
+		g = c.gates[gateKey(addr)]
+	}
+	if g == nil || len(g.waiters) == 0 {
+		g = nil
+		for _, other := range c.gates {
+			if len(other.waiters) > 0 {
+				g = other
+				break
+			}
+		}
+	}
+	if g == nil {
+		return false
+	}
+	w := g.waiters[0]
+	g.waiters = g.waiters[1:]
+	raw := conn
+	if exconn, ok := conn.(*Conn); ok {
+		raw = exconn._conn
+	}
+	w.result <- dialResult{conn: &Conn{_conn: raw, closer: c, epoch: s.epoch}}
+	atomic.AddInt64(&c.metricDialHandoff, 1)
+	return true
+}
+
+// gc remove g from gates if it's idle, the caller must hold gatesMtx.
+func (c *Cluster) gc(addr net.Addr, g *dialGate) {
+	if g.inflight == 0 && len(g.waiters) == 0 && c.gates[gateKey(addr)] == g {
+		delete(c.gates, gateKey(addr))
+	}
+}
+
+func gateKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// remove w from g, return false if it's already removed
+func (g *dialGate) remove(w *dialWaiter) bool {
+	for i, other := range g.waiters {
+		if other == w {
+			g.waiters = append(g.waiters[:i:i], g.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
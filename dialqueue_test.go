@@ -0,0 +1,230 @@
+package exnet_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+// slowTLSServer delays every TLS handshake, so dials are in progress for a
+// while, and counts the dials, a dial is in progress until the delay ends
+type slowTLSServer struct {
+	net.Listener
+	accepted    int32
+	inflight    int32
+	maxInflight int32
+}
+
+func newSlowTLSServer(t *testing.T, delay time.Duration) (*slowTLSServer, *tls.Config) {
+	cert, pool := testCertificate(t, "server")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &slowTLSServer{Listener: lis}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			go func() {
+				n := atomic.AddInt32(&s.inflight, 1)
+				for {
+					max := atomic.LoadInt32(&s.maxInflight)
+					if n <= max || atomic.CompareAndSwapInt32(&s.maxInflight, max, n) {
+						break
+					}
+				}
+				time.Sleep(delay)
+				atomic.AddInt32(&s.inflight, -1)
+				tlsConn := tls.Server(conn, conf)
+				if tlsConn.Handshake() == nil {
+					_, _ = ioutil.ReadAll(tlsConn)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+	return s, &tls.Config{RootCAs: pool}
+}
+
+func newQueuedCluster(t *testing.T, s *slowTLSServer, tlsConf *tls.Config, maxDials int) *exnet.Cluster {
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", s.Addr().String()))
+	return exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:     time.Second,
+		AddressPicker:   ap,
+		PoolConfig:      &exnet.ConnPoolConfig{Cap: 20},
+		TLSConfig:       tlsConf,
+		MaxDialsPerAddr: maxDials,
+	})
+}
+
+func TestClusterMaxDialsPerAddr(t *testing.T) {
+	server, tlsConf := newSlowTLSServer(t, 50*time.Millisecond)
+	defer server.Close()
+	cluster := newQueuedCluster(t, server, tlsConf, 2)
+
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := cluster.Dial("", "")
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			_ = cluster.Close(conn)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(0), failed)
+	assert.True(t, atomic.LoadInt32(&server.maxInflight) <= 2, "%d dials in progress", server.maxInflight)
+	assert.True(t, atomic.LoadInt32(&server.accepted) < 20, "%d dials", server.accepted)
+	metrics := cluster.Metrics()
+	assert.True(t, metrics["dial_wait"] > 0, "%v", metrics)
+	assert.True(t, metrics["dial_handoff"] > 0, "%v", metrics)
+}
+
+func TestClusterMaxDialsPerAddrCancel(t *testing.T) {
+	server, tlsConf := newSlowTLSServer(t, 200*time.Millisecond)
+	defer server.Close()
+	cluster := newQueuedCluster(t, server, tlsConf, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cluster.DialContext(ctx, "", "")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 150*time.Millisecond)
+
+	// the dial goes on, its connection is put into pool
+	time.Sleep(300 * time.Millisecond)
+	conn, err := cluster.Dial("", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), cluster.Metrics()["dial_pool_reuse"])
+		assert.Equal(t, int32(1), atomic.LoadInt32(&server.accepted))
+		conn.Close()
+	}
+}
+
+func TestClusterMaxDialsPerAddrProxy(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := newTestProxy(t, func(p *testProxy, conn net.Conn) {
+		time.Sleep(100 * time.Millisecond)
+		serveHTTPConnect(p, conn)
+	})
+	defer proxy.Close()
+
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", echo.Addr().String()))
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:     time.Second,
+		AddressPicker:   ap,
+		PoolConfig:      &exnet.ConnPoolConfig{Cap: 2},
+		Proxy:           &exnet.ProxyConfig{Type: exnet.ProxyHTTP, Address: proxy.Addr().String()},
+		MaxDialsPerAddr: 1,
+	})
+	first, err := cluster.Dial("tcp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the first waiter gets the connection returned, the next one gets
+	// the connection dialed for the first
+	conns := make(chan net.Conn, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := cluster.Dial("tcp", "")
+			assert.NoError(t, err)
+			conns <- conn
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, cluster.Close(first))
+	got := []net.Conn{<-conns, <-conns}
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_handoff"])
+	for _, conn := range got {
+		if conn == nil {
+			continue
+		}
+		assert.Equal(t, echo.Addr().String(), conn.RemoteAddr().String())
+		assert.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+		assertEcho(t, conn, "hello")
+		conn.Close()
+	}
+}
+
+func TestClusterMaxDialsPerAddrHandoffSameAddr(t *testing.T) {
+	echoes := []net.Listener{echoServer(t), echoServer(t)}
+	proxy := newTestProxy(t, func(p *testProxy, conn net.Conn) {
+		time.Sleep(200 * time.Millisecond)
+		serveHTTPConnect(p, conn)
+	})
+	defer proxy.Close()
+
+	ap := addresspicker.NewRoundRobin(nil)
+	for _, echo := range echoes {
+		defer echo.Close()
+		assert.NoError(t, ap.AppendTCPAddress("tcp", echo.Addr().String()))
+	}
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:     time.Second,
+		AddressPicker:   ap,
+		PoolConfig:      &exnet.ConnPoolConfig{Cap: 4},
+		Proxy:           &exnet.ProxyConfig{Type: exnet.ProxyHTTP, Address: proxy.Addr().String()},
+		MaxDialsPerAddr: 1,
+	})
+	first, err := cluster.Dial("tcp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	second, err := cluster.Dial("tcp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer second.Close()
+
+	// callers waiting for dials in progress to every address, two for each
+	conns := make([]chan net.Conn, 4)
+	for i := range conns {
+		conns[i] = make(chan net.Conn, 1)
+		go func(ch chan net.Conn) {
+			conn, err := cluster.Dial("tcp", "")
+			assert.NoError(t, err)
+			ch <- conn
+		}(conns[i])
+		time.Sleep(20 * time.Millisecond)
+	}
+	// the connection returned goes to the first caller of its address
+	assert.NoError(t, cluster.Close(first))
+	select {
+	case conn := <-conns[0]:
+		if assert.NotNil(t, conn) {
+			assert.Equal(t, echoes[0].Addr().String(), conn.RemoteAddr().String())
+			conn.Close()
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the waiter of the address is not handed the connection")
+	}
+	for _, i := range []int{1, 2, 3} {
+		if conn := <-conns[i]; conn != nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package exnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// min number of addresses tracked before idle ones are forgotten
+const dialRateSweepAddrs = 64
+
+// DialRateLimitConfig config for rate limits of new connections dialed by
+// Cluster, connections reused from the pool are not limited.
+type DialRateLimitConfig struct {
+	// Rate is the number of connections dialed per second by the cluster,
+	// 0 means no limit.
+	Rate float64
+	// Burst is the max number of connections dialed at once by the
+	// cluster, default is 1.
+	Burst int
+	// PerAddrRate is the number of connections dialed per second to an
+	// address, 0 means no limit.
+	PerAddrRate float64
+	// PerAddrBurst is the max number of connections dialed at once to an
+	// address, default is 1.
+	PerAddrBurst int
+	// FailFast return a DialRateLimitError if a dial is over the limits,
+	// otherwise the dial waits until it's allowed, or the context is done.
+	FailFast bool
+}
+
+// dialLimiter keeps token buckets of Cluster, the cluster-wide one and one
+// per address. Tokens can be negative, which are reserved by dials waiting.
+type dialLimiter struct {
+	mtx     sync.Mutex
+	cluster *tokenBucket
+	addrs   map[string]*tokenBucket
+	sweepAt int
+}
+
+// wait take a token from both buckets of addr, wait until they are
+// available if conf is not FailFast. The tokens are given back if ctx is
+// done before.
+func (l *dialLimiter) wait(ctx context.Context, conf *DialRateLimitConfig, addr net.Addr) error {
+	key := gateKey(addr)
+	now := time.Now()
+
+	l.mtx.Lock()
+	cluster, perAddr := l.buckets(conf, key, now)
+	var d time.Duration
+	if conf.FailFast {
+		d = maxDuration(cluster.delay(conf.Rate), perAddr.delay(conf.PerAddrRate))
+		if d == 0 {
+			cluster.reserve(conf.Rate)
+			perAddr.reserve(conf.PerAddrRate)
+		}
+	} else {
+		d = maxDuration(cluster.reserve(conf.Rate), perAddr.reserve(conf.PerAddrRate))
+	}
+	l.mtx.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	err := &DialRateLimitError{Address: addr.String(), Wait: d}
+	if conf.FailFast {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(now.Add(d)) {
+		// no token in time
+		l.cancel(cluster, perAddr)
+		return err
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(cluster, perAddr)
+		return ctx.Err()
+	}
+}
+
+// buckets return the buckets refilled to now, nil if there is no limit.
+// The caller must hold mtx.
+func (l *dialLimiter) buckets(conf *DialRateLimitConfig, key string, now time.Time) (cluster, perAddr *tokenBucket) {
+	if conf.Rate > 0 {
+		if l.cluster == nil {
+			b := newTokenBucket(burstOf(conf.Burst), now)
+			l.cluster = &b
+		}
+		l.cluster.refill(now, conf.Rate, burstOf(conf.Burst))
+		cluster = l.cluster
+	}
+	if conf.PerAddrRate > 0 {
+		burst := burstOf(conf.PerAddrBurst)
+		if perAddr = l.addrs[key]; perAddr == nil {
+			l.sweep(now, conf.PerAddrRate, burst)
+			b := newTokenBucket(burst, now)
+			perAddr = &b
+			if l.addrs == nil {
+				l.addrs = make(map[string]*tokenBucket)
+			}
+			l.addrs[key] = perAddr
+		}
+		perAddr.refill(now, conf.PerAddrRate, burst)
+	}
+	return cluster, perAddr
+}
+
+// sweep forget addresses whose buckets are full, as they're not dialed
+// recently. It runs when the addresses double, so it's amortized.
+func (l *dialLimiter) sweep(now time.Time, rate float64, burst int) {
+	if len(l.addrs) < l.sweepAt || len(l.addrs) < dialRateSweepAddrs {
+		return
+	}
+	for key, b := range l.addrs {
+		if b.refill(now, rate, burst); b.tokens >= float64(burst) {
+			delete(l.addrs, key)
+		}
+	}
+	l.sweepAt = 2 * len(l.addrs)
+}
+
+// cancel give back the tokens reserved
+func (l *dialLimiter) cancel(cluster, perAddr *tokenBucket) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if cluster != nil {
+		cluster.tokens++
+	}
+	if perAddr != nil {
+		perAddr.tokens++
+	}
+}
+
+// delay return the duration until b has a token, b must be refilled
+func (b *tokenBucket) delay(rate float64) time.Duration {
+	if b == nil || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// reserve take a token even if there is none, return the duration until
+// the token is refilled, b must be refilled
+func (b *tokenBucket) reserve(rate float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func burstOf(burst int) int {
+	if burst <= 0 {
+		return 1
+	}
+	return burst
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// rateLimit wait for the dial rate limits of s, if any
+func (c *Cluster) rateLimit(ctx context.Context, s *clusterSnapshot, addr net.Addr) error {
+	if s.dialRate == nil {
+		return nil
+	}
+	err := c.limiter.wait(ctx, s.dialRate, addr)
+	if _, ok := err.(*DialRateLimitError); ok {
+		atomic.AddInt64(&c.metricDialRateLimited, 1)
+	}
+	return err
+}
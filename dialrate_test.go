@@ -0,0 +1,118 @@
+package exnet_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func newRateLimitedCluster(t *testing.T, conf *exnet.DialRateLimitConfig, addrs ...net.Addr) *exnet.Cluster {
+	ap := addresspicker.NewRoundRobin(nil)
+	for _, addr := range addrs {
+		assert.NoError(t, ap.AppendTCPAddress("tcp", addr.String()))
+	}
+	return exnet.NewCluster(&exnet.ClusterConfig{
+		AddressPicker: ap,
+		PoolConfig:    &exnet.ConnPoolConfig{Cap: 10},
+		DialRateLimit: conf,
+	})
+}
+
+func TestClusterDialRateLimitFailFast(t *testing.T) {
+	echo1, echo2 := echoServer(t), echoServer(t)
+	defer echo1.Close()
+	defer echo2.Close()
+
+	// per address
+	cluster := newRateLimitedCluster(t, &exnet.DialRateLimitConfig{
+		PerAddrRate: 0.1,
+		FailFast:    true,
+	}, echo1.Addr(), echo2.Addr())
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := cluster.Dial("", "")
+		if assert.NoError(t, err) {
+			conns = append(conns, conn)
+		}
+	}
+	_, err := cluster.Dial("", "")
+	var rerr *exnet.DialRateLimitError
+	if assert.True(t, errors.As(err, &rerr), "%v", err) {
+		assert.True(t, errors.Is(err, exnet.ErrRateLimited))
+		assert.True(t, rerr.Wait > 9*time.Second, "%s", rerr.Wait)
+	}
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_rate_limited"])
+
+	// pool reuse is not limited
+	for _, conn := range conns {
+		assert.NoError(t, cluster.Close(conn))
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := cluster.Dial("", "")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, int64(2), cluster.Metrics()["dial_pool_reuse"])
+
+	// cluster-wide
+	cluster = newRateLimitedCluster(t, &exnet.DialRateLimitConfig{
+		Rate:     0.1,
+		Burst:    2,
+		FailFast: true,
+	}, echo1.Addr(), echo2.Addr())
+	for i := 0; i < 2; i++ {
+		conn, err := cluster.Dial("", "")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	_, err = cluster.Dial("", "")
+	assert.True(t, errors.Is(err, exnet.ErrRateLimited), "%v", err)
+}
+
+func TestClusterDialRateLimitWait(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	cluster := newRateLimitedCluster(t, &exnet.DialRateLimitConfig{
+		PerAddrRate: 10,
+	}, echo.Addr())
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := cluster.Dial("", "")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "%s", time.Since(start))
+
+	// no token before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err := cluster.DialContext(ctx, "", "")
+	var rerr *exnet.DialRateLimitError
+	assert.True(t, errors.As(err, &rerr), "%v", err)
+	assert.True(t, time.Since(start) < 10*time.Millisecond)
+
+	// canceled while waiting, the token is given back
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = cluster.DialContext(ctx, "", "")
+	assert.Equal(t, context.Canceled, err)
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	conn, err := cluster.Dial("", "")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "%s", time.Since(start))
+}
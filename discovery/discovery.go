@@ -0,0 +1,171 @@
+// Package discovery feeds addresses of services into exnet address pickers.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+var (
+	// ErrUnknownService if a service is not in the registry
+	ErrUnknownService = errors.New("Unknown service")
+	// ErrPickerNotUpdatable if an address picker can't be updated at runtime
+	ErrPickerNotUpdatable = errors.New("AddressPicker is not an addresspicker.Updater")
+)
+
+// Update is a membership snapshot of a service
+type Update struct {
+	Service   string
+	Endpoints []addresspicker.Endpoint
+	// Index of the snapshot in registry, 0 if the registry has no index
+	Index uint64
+	// Err is set if the registry can't be queried, the subscription will
+	// go on and Endpoints is empty.
+	Err error
+}
+
+// Discovery produces membership updates of services
+type Discovery interface {
+	// Subscribe membership of service, the current membership is sent
+	// first and then every change of it. The channel is closed when ctx
+	// is done.
+	Subscribe(ctx context.Context, service string) (<-chan Update, error)
+}
+
+// Feed membership of service from d into address pickers, it blocks until
+// ctx is done or the subscription stops. Updates with error are skipped so
+// pickers keep their last good addresses. An update without endpoints, e.g.
+// the service is removed from FileRegistry, empties the pickers, so dials
+// fail with exnet.ErrNoAddress, like pickers bound to FileRegistry.
+func Feed(ctx context.Context, d Discovery, service string, pickers ...addresspicker.Updater) error {
+	ch, err := d.Subscribe(ctx, service)
+	if err != nil {
+		return err
+	}
+	for u := range ch {
+		if u.Err != nil {
+			continue
+		}
+		for _, p := range pickers {
+			p.Update(u.Endpoints)
+		}
+	}
+	return ctx.Err()
+}
+
+// ClusterUpdater return AddressPicker of cluster as an addresspicker.Updater,
+// a WeightedRoundRobin picker is set if the cluster has no AddressPicker.
+func ClusterUpdater(c *exnet.Cluster) (addresspicker.Updater, error) {
+	ap := c.Picker()
+	if ap == nil {
+		conf := c.Config()
+		conf.AddressPicker = addresspicker.NewWeightedRoundRobin(nil)
+		if err := c.Update(conf); err != nil {
+			return nil, err
+		}
+		ap = conf.AddressPicker
+	}
+	u, ok := ap.(addresspicker.Updater)
+	if !ok {
+		return nil, ErrPickerNotUpdatable
+	}
+	return u, nil
+}
+
+// EndpointSpec is an endpoint in registry file or response
+type EndpointSpec struct {
+	// Network of the address, default is "tcp", unix and unixpacket
+	// addresses are socket paths
+	Network string   `json:"network" yaml:"network"`
+	Address string   `json:"address" yaml:"address"`
+	Weight  int      `json:"weight" yaml:"weight"`
+	Zone    string   `json:"zone" yaml:"zone"`
+	Tags    []string `json:"tags" yaml:"tags"`
+}
+
+// Endpoint resolve the spec into an addresspicker.Endpoint
+func (spec *EndpointSpec) Endpoint() (addresspicker.Endpoint, error) {
+	if spec.Weight < 0 {
+		return addresspicker.Endpoint{}, fmt.Errorf("negative weight %d", spec.Weight)
+	}
+	network := spec.Network
+	if network == "" {
+		network = "tcp"
+	}
+	var addr net.Addr
+	var err error
+	switch network {
+	case "unix", "unixpacket":
+		addr, err = addresspicker.ResolveUnixAddr(network, spec.Address)
+	default:
+		addr, err = addresspicker.ResolveTCPAddr(network, spec.Address)
+	}
+	if err != nil {
+		return addresspicker.Endpoint{}, err
+	}
+	return addresspicker.Endpoint{
+		Addr:   addr,
+		Weight: spec.Weight,
+		Zone:   spec.Zone,
+		Tags:   spec.Tags,
+	}, nil
+}
+
+func parseEndpoints(specs []EndpointSpec) ([]addresspicker.Endpoint, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no endpoint")
+	}
+	endpoints := make([]addresspicker.Endpoint, 0, len(specs))
+	for i, spec := range specs {
+		ep, err := spec.Endpoint()
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %d: %w", i, err)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// chanUpdater send updates to a channel, a pending update not received
+// yet is replaced by the newer one, so senders of errors must send the
+// membership again after them.
+type chanUpdater struct {
+	service string
+	ch      chan Update
+	mtx     sync.Mutex
+}
+
+func newChanUpdater(service string) *chanUpdater {
+	return &chanUpdater{
+		service: service,
+		ch:      make(chan Update, 1),
+	}
+}
+
+func (u *chanUpdater) Update(endpoints []addresspicker.Endpoint) {
+	u.send(Update{Service: u.service, Endpoints: endpoints})
+}
+
+func (u *chanUpdater) send(update Update) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	select {
+	case <-u.ch:
+	default:
+	}
+	u.ch <- update
+}
+
+// close the channel, no update can be sent after it
+func (u *chanUpdater) close() {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	close(u.ch)
+}
@@ -0,0 +1,348 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+const (
+	defaultFileInterval = time.Second
+	// max granularity of modification time, e.g. 2 seconds of FAT
+	fileRacyWindow = 2 * time.Second
+)
+
+// FileRegistryConfig config for FileRegistry
+type FileRegistryConfig struct {
+	// Path of the registry file, format is detected by extension,
+	// ".yaml" and ".yml" are YAML, others are JSON.
+	Path string
+	// Interval to poll the file, default is 1 second. The file is read only
+	// if its size or modification time changed, or it was modified shortly
+	// before the last read, so a change within one tick of modification
+	// time is found. The content is compared then, touching the file
+	// doesn't reload it.
+	Interval time.Duration
+	// OnError will be called when a reload is rejected, the last good
+	// state is kept.
+	OnError func(error)
+}
+
+// FileRegistry read services from a JSON or YAML file and watch it by polling,
+// the file maps service names to their endpoints, e.g.
+//
+//	{
+//	    "echo": [
+//	        {"address": "192.168.0.1:8756", "weight": 10, "zone": "bj", "tags": ["canary"]},
+//	        {"address": "192.168.0.2:8756", "weight": 20, "zone": "sh"}
+//	    ]
+//	}
+//
+// Bound address pickers are updated when the file changes, a malformed file
+// is rejected as a whole and the last good state is kept. A service removed
+// from the file updates its pickers with no endpoint, so dials to it fail
+// with exnet.ErrNoAddress until it's back.
+type FileRegistry struct {
+	path     string
+	interval time.Duration
+	onError  func(error)
+
+	mtx      sync.Mutex
+	services map[string][]addresspicker.Endpoint
+	bindings map[string][]addresspicker.Updater
+	// checksum of the file last read, missing if it can't be read
+	sum     [sha256.Size]byte
+	missing bool
+	// stat of the file last read and when it's read
+	size    int64
+	modTime time.Time
+	readAt  time.Time
+	lastErr error
+
+	stopch chan struct{}
+	donech chan struct{}
+}
+
+var _ Discovery = &FileRegistry{}
+
+// NewFileRegistry create a FileRegistry and load the file, the file is not
+// watched until Watch is called.
+func NewFileRegistry(conf *FileRegistryConfig) (*FileRegistry, error) {
+	if conf == nil {
+		panic("FileRegistryConfig can't be nil")
+	}
+	r := &FileRegistry{
+		path:     conf.Path,
+		interval: conf.Interval,
+		onError:  conf.OnError,
+		bindings: make(map[string][]addresspicker.Updater),
+	}
+	if r.interval <= 0 {
+		r.interval = defaultFileInterval
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Bind an address picker to service, the picker is updated immediately
+// and every time the service changes.
+func (r *FileRegistry) Bind(service string, u addresspicker.Updater) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	endpoints, ok := r.services[service]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownService, service)
+	}
+	u.Update(endpoints)
+	r.bindings[service] = append(r.bindings[service], u)
+	return nil
+}
+
+// BindCluster bind AddressPicker of cluster to service, a WeightedRoundRobin
+// picker is created if the cluster has no AddressPicker.
+func (r *FileRegistry) BindCluster(service string, c *exnet.Cluster) error {
+	u, err := ClusterUpdater(c)
+	if err != nil {
+		return err
+	}
+	return r.Bind(service, u)
+}
+
+// Subscribe membership of service, implements Discovery
+func (r *FileRegistry) Subscribe(ctx context.Context, service string) (<-chan Update, error) {
+	u := newChanUpdater(service)
+	if err := r.Bind(service, u); err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		r.unbind(service, u)
+		u.close()
+	}()
+	return u.ch, nil
+}
+
+func (r *FileRegistry) unbind(service string, u addresspicker.Updater) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	updaters := r.bindings[service]
+	for i := range updaters {
+		if updaters[i] == u {
+			r.bindings[service] = append(updaters[:i:i], updaters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Endpoints return current endpoints of service
+func (r *FileRegistry) Endpoints(service string) ([]addresspicker.Endpoint, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	endpoints, ok := r.services[service]
+	return endpoints, ok
+}
+
+// Services return names of all services in registry
+func (r *FileRegistry) Services() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LastError return the error of last reload, nil if it succeed
+func (r *FileRegistry) LastError() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lastErr
+}
+
+// Reload the file and update bound pickers, if the file is malformed,
+// the last good state is kept and the error is returned.
+func (r *FileRegistry) Reload() error {
+	b, err := r.read()
+	r.changed(b, err)
+	return r.load(b, err)
+}
+
+// read the file and record its stat
+func (r *FileRegistry) read() ([]byte, error) {
+	now := time.Now()
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(r.path)
+	r.mtx.Lock()
+	r.size, r.modTime, r.readAt = fi.Size(), fi.ModTime(), now
+	r.mtx.Unlock()
+	return b, err
+}
+
+// stale report whether the file may be changed since last read by its stat,
+// a file modified within fileRacyWindow before the last read may be
+// modified again in the same tick of modification time.
+func (r *FileRegistry) stale() bool {
+	fi, err := os.Stat(r.path)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		return !r.missing
+	}
+	return r.missing || fi.Size() != r.size || !fi.ModTime().Equal(r.modTime) ||
+		fi.ModTime().After(r.readAt.Add(-fileRacyWindow))
+}
+
+// load services from b, the content of the file, or reject err of reading it
+func (r *FileRegistry) load(b []byte, err error) error {
+	if err != nil {
+		return r.reject(err)
+	}
+	services, err := parseRegistryFile(r.path, b)
+	if err != nil {
+		return r.reject(err)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.lastErr = nil
+	r.services = services
+	for name, updaters := range r.bindings {
+		// nil for the removed service
+		endpoints := services[name]
+		for _, u := range updaters {
+			u.Update(endpoints)
+		}
+	}
+	return nil
+}
+
+// Watch start polling the file in background until Close called
+func (r *FileRegistry) Watch() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.stopch != nil {
+		return
+	}
+	r.stopch = make(chan struct{})
+	r.donech = make(chan struct{})
+	go r.poll(r.stopch, r.donech)
+}
+
+// Close stop watching the file
+func (r *FileRegistry) Close() error {
+	r.mtx.Lock()
+	stopch, donech := r.stopch, r.donech
+	r.stopch, r.donech = nil, nil
+	r.mtx.Unlock()
+
+	if stopch != nil {
+		close(stopch)
+		<-donech
+	}
+	return nil
+}
+
+func (r *FileRegistry) poll(stopch, donech chan struct{}) {
+	defer close(donech)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopch:
+			return
+		case <-ticker.C:
+		}
+		if !r.stale() {
+			continue
+		}
+		b, err := r.read()
+		if r.changed(b, err) {
+			_ = r.load(b, err)
+		}
+	}
+}
+
+// changed record checksum of b, the content of the file read with err,
+// return whether it is changed since last read. An unreadable file, e.g.
+// missing, is reported once until it comes back.
+func (r *FileRegistry) changed(b []byte, err error) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err != nil {
+		if r.missing {
+			return false
+		}
+		r.missing = true
+		return true
+	}
+	sum := sha256.Sum256(b)
+	if !r.missing && sum == r.sum {
+		return false
+	}
+	r.sum, r.missing = sum, false
+	return true
+}
+
+func (r *FileRegistry) reject(err error) error {
+	err = fmt.Errorf("discovery: reload %s: %w", r.path, err)
+	r.mtx.Lock()
+	r.lastErr = err
+	r.mtx.Unlock()
+	if r.onError != nil {
+		r.onError(err)
+	}
+	return err
+}
+
+func parseRegistryFile(path string, b []byte) (map[string][]addresspicker.Endpoint, error) {
+	var err error
+	var raw map[string][]EndpointSpec
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &raw)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string][]addresspicker.Endpoint, len(raw))
+	for name, specs := range raw {
+		endpoints, err := parseEndpoints(specs)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: %w", name, err)
+		}
+		services[name] = endpoints
+	}
+	return services, nil
+}
@@ -0,0 +1,216 @@
+package discovery_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+	"github.com/eddix/exnet/discovery"
+)
+
+type testUpdater struct {
+	endpoints chan []addresspicker.Endpoint
+}
+
+func (u *testUpdater) Update(endpoints []addresspicker.Endpoint) {
+	u.endpoints <- endpoints
+}
+
+// writeFile write content to path with mtime truncated to seconds, as if
+// the file system has coarse timestamps, so writes within a second keep
+// the mtime unchanged.
+func writeFile(t *testing.T, path, content string) {
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	mtime := time.Now().Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestFileRegistry(t *testing.T) {
+	t.Run("JSON", func(t *testing.T) {
+		testFileRegistry(t, "services.json",
+			`{"echo": [{"address": "127.0.0.1:8001", "weight": 10, "zone": "bj", "tags": ["canary"]}]}`,
+			`{"echo": [{"address": "127.0.0.1:8001"}, {"address": "127.0.0.1:8002", "weight": 2}]}`,
+			`{"echo": [{"address": "127.0.0.1:8003", "weight": "heavy"}]}`)
+	})
+	t.Run("YAML", func(t *testing.T) {
+		testFileRegistry(t, "services.yaml", `
+echo:
+  - address: 127.0.0.1:8001
+    weight: 10
+    zone: bj
+    tags: [canary]
+`, `
+echo:
+  - address: 127.0.0.1:8001
+  - address: 127.0.0.1:8002
+    weight: 2
+`, `
+echo:
+  - address: 127.0.0.1:8003
+    wieght: 2
+`)
+	})
+}
+
+func testFileRegistry(t *testing.T, name, initial, updated, malformed string) {
+	dir, err := ioutil.TempDir("", "exnet-discovery")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	writeFile(t, path, initial)
+
+	errch := make(chan error, 1)
+	r, err := discovery.NewFileRegistry(&discovery.FileRegistryConfig{
+		Path:     path,
+		Interval: 5 * time.Millisecond,
+		OnError:  func(err error) { errch <- err },
+	})
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, []string{"echo"}, r.Services())
+
+	u := &testUpdater{endpoints: make(chan []addresspicker.Endpoint, 1)}
+	assert.Error(t, r.Bind("unknown", u))
+	assert.NoError(t, r.Bind("echo", u))
+	eps := <-u.endpoints
+	assert.Len(t, eps, 1)
+	assert.Equal(t, "127.0.0.1:8001", eps[0].Addr.String())
+	assert.Equal(t, 10, eps[0].Weight)
+	assert.Equal(t, "bj", eps[0].Zone)
+	assert.Equal(t, []string{"canary"}, eps[0].Tags)
+
+	r.Watch()
+	writeFile(t, path, updated)
+	select {
+	case eps = <-u.endpoints:
+	case <-time.After(time.Second):
+		t.Fatal("picker is not updated")
+	}
+	assert.Len(t, eps, 2)
+	assert.Equal(t, "127.0.0.1:8002", eps[1].Addr.String())
+
+	// malformed update keeps last good state
+	writeFile(t, path, malformed)
+	select {
+	case err = <-errch:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("malformed file is not rejected")
+	}
+	assert.Error(t, r.LastError())
+	assert.Len(t, u.endpoints, 0)
+	eps, ok := r.Endpoints("echo")
+	assert.True(t, ok)
+	assert.Len(t, eps, 2)
+}
+
+func TestFileRegistrySubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet-discovery")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	writeFile(t, path, `{"echo": [{"address": "127.0.0.1:8001"}]}`)
+
+	r, err := discovery.NewFileRegistry(&discovery.FileRegistryConfig{
+		Path:     path,
+		Interval: 5 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	r.Watch()
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = r.Subscribe(ctx, "unknown")
+	assert.Error(t, err)
+	ch, err := r.Subscribe(ctx, "echo")
+	assert.NoError(t, err)
+	u := nextUpdate(t, ch)
+	assert.Equal(t, "echo", u.Service)
+	assert.Equal(t, "127.0.0.1:8001", u.Endpoints[0].Addr.String())
+
+	writeFile(t, path, `{"echo": [{"address": "127.0.0.1:8002"}]}`)
+	u = nextUpdate(t, ch)
+	assert.Equal(t, "127.0.0.1:8002", u.Endpoints[0].Addr.String())
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestFileRegistryBindCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet-discovery")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	writeFile(t, path, `{"echo": [{"address": "127.0.0.1:8001", "weight": 3}, {"address": "127.0.0.1:8002"}]}`)
+
+	r, err := discovery.NewFileRegistry(&discovery.FileRegistryConfig{Path: path})
+	assert.NoError(t, err)
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{})
+	assert.NoError(t, r.BindCluster("echo", cluster))
+
+	picked := map[string]int{}
+	for i := 0; i < 8; i++ {
+		picked[cluster.Picker().Addr().String()]++
+	}
+	assert.Equal(t, map[string]int{"127.0.0.1:8001": 6, "127.0.0.1:8002": 2}, picked)
+}
+
+func TestFileRegistryRemoveService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet-discovery")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	writeFile(t, path, `{"echo": [{"address": "127.0.0.1:8001"}], "other": [{"address": "127.0.0.1:9001"}]}`)
+
+	r, err := discovery.NewFileRegistry(&discovery.FileRegistryConfig{
+		Path:     path,
+		Interval: 5 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	r.Watch()
+	defer r.Close()
+	u := &testUpdater{endpoints: make(chan []addresspicker.Endpoint, 1)}
+	assert.NoError(t, r.Bind("echo", u))
+	assert.Len(t, <-u.endpoints, 1)
+	// pickers fed by the subscription are emptied too
+	fed := &testUpdater{endpoints: make(chan []addresspicker.Endpoint, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = discovery.Feed(ctx, r, "echo", fed) }()
+	assert.Len(t, <-fed.endpoints, 1)
+
+	// same size, only the service is renamed
+	writeFile(t, path, `{"ohce": [{"address": "127.0.0.1:8001"}], "other": [{"address": "127.0.0.1:9001"}]}`)
+	for _, u := range []*testUpdater{u, fed} {
+		select {
+		case eps := <-u.endpoints:
+			assert.Len(t, eps, 0)
+		case <-time.After(time.Second):
+			t.Fatal("picker of removed service is not updated")
+		}
+	}
+	_, ok := r.Endpoints("echo")
+	assert.False(t, ok)
+
+	writeFile(t, path, `{"echo": [{"address": "127.0.0.1:8002"}], "other": [{"address": "127.0.0.1:9001"}]}`)
+	select {
+	case eps := <-u.endpoints:
+		assert.Equal(t, "127.0.0.1:8002", eps[0].Addr.String())
+	case <-time.After(time.Second):
+		t.Fatal("picker of restored service is not updated")
+	}
+	select {
+	case eps := <-fed.endpoints:
+		assert.Equal(t, "127.0.0.1:8002", eps[0].Addr.String())
+	case <-time.After(time.Second):
+		t.Fatal("fed picker of restored service is not updated")
+	}
+}
@@ -0,0 +1,203 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPWait          = 30 * time.Second
+	defaultHTTPRetryInterval = time.Second
+	defaultHTTPIndexHeader   = "X-Index"
+	maxHTTPRetryBackoff      = 32
+)
+
+// HTTPConfig config for HTTPDiscovery
+type HTTPConfig struct {
+	// URL of the registry, service name is appended as the last path
+	// segment, e.g. "http://registry:8500/v1/services/".
+	URL string
+	// Client to query the registry, default is http.DefaultClient
+	Client *http.Client
+	// Wait is the max duration a blocking query waits for changes,
+	// default is 30 seconds.
+	Wait time.Duration
+	// RetryInterval is the first backoff after a failed query, it doubles
+	// on every consecutive failure. Default is 1 second.
+	RetryInterval time.Duration
+	// IndexHeader is the response header carrying the registry index,
+	// default is "X-Index".
+	IndexHeader string
+}
+
+// HTTPDiscovery long-polls a registry speaking JSON over HTTP with
+// index-based blocking queries, the same way Consul does:
+//
+//	GET {URL}/{service}?index=42&wait=30s
+//
+// The registry holds the request until the membership index is greater
+// than 42 or wait is expired, then responses with the current index in
+// header and a JSON list of EndpointSpec in body.
+type HTTPDiscovery struct {
+	url           string
+	client        *http.Client
+	wait          time.Duration
+	retryInterval time.Duration
+	indexHeader   string
+}
+
+var _ Discovery = &HTTPDiscovery{}
+
+// NewHTTPDiscovery create an HTTPDiscovery
+func NewHTTPDiscovery(conf *HTTPConfig) *HTTPDiscovery {
+	if conf == nil {
+		panic("HTTPConfig can't be nil")
+	}
+	d := &HTTPDiscovery{
+		url:           conf.URL,
+		client:        conf.Client,
+		wait:          conf.Wait,
+		retryInterval: conf.RetryInterval,
+		indexHeader:   conf.IndexHeader,
+	}
+	if d.client == nil {
+		d.client = http.DefaultClient
+	}
+	if d.wait <= 0 {
+		d.wait = defaultHTTPWait
+	}
+	if d.retryInterval <= 0 {
+		d.retryInterval = defaultHTTPRetryInterval
+	}
+	if d.indexHeader == "" {
+		d.indexHeader = defaultHTTPIndexHeader
+	}
+	return d
+}
+
+// Subscribe membership of service, implements Discovery. Query errors are
+// sent as updates with Err and the query is retried with backoff, the
+// membership is sent again when the registry recovers, even if it's not
+// changed, as an update not received yet is replaced by the error.
+func (d *HTTPDiscovery) Subscribe(ctx context.Context, service string) (<-chan Update, error) {
+	if _, err := url.Parse(d.url); err != nil {
+		return nil, err
+	}
+	u := newChanUpdater(service)
+	go d.poll(ctx, service, u)
+	return u.ch, nil
+}
+
+func (d *HTTPDiscovery) poll(ctx context.Context, service string, u *chanUpdater) {
+	defer u.close()
+
+	var index uint64
+	failures := 0
+	for ctx.Err() == nil {
+		queryIndex := index
+		if failures > 0 {
+			// don't block, the membership is sent again on recovery
+			queryIndex = 0
+		}
+		update, err := d.query(ctx, service, queryIndex)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			u.send(Update{Service: service, Index: index, Err: err})
+			if !sleepContext(ctx, d.backoff(failures)) {
+				return
+			}
+			failures++
+			continue
+		}
+		recovered := failures > 0
+		failures = 0
+		switch {
+		case update.Index == 0:
+			// registry doesn't support blocking query, poll it periodically
+			u.send(update)
+			if !sleepContext(ctx, d.retryInterval) {
+				return
+			}
+		case update.Index < index:
+			// index goes backwards, e.g. registry restarted, start over
+			index = 0
+		case update.Index == index && !recovered:
+			// blocking query timeout without change
+		default:
+			index = update.Index
+			u.send(update)
+		}
+	}
+}
+
+func (d *HTTPDiscovery) query(ctx context.Context, service string, index uint64) (Update, error) {
+	update := Update{Service: service}
+
+	q := url.Values{}
+	q.Set("index", strconv.FormatUint(index, 10))
+	q.Set("wait", d.wait.String())
+	target := strings.TrimSuffix(d.url, "/") + "/" + url.PathEscape(service) + "?" + q.Encode()
+
+	// give the registry some time to answer after wait is expired
+	ctx, cancel := context.WithTimeout(ctx, d.wait+d.wait/16+5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return update, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return update, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return update, fmt.Errorf("discovery: query %s: unexpected status %s", service, resp.Status)
+	}
+	if h := resp.Header.Get(d.indexHeader); h != "" {
+		update.Index, err = strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			return update, fmt.Errorf("discovery: query %s: bad index %q", service, h)
+		}
+	}
+	var specs []EndpointSpec
+	if err = json.NewDecoder(resp.Body).Decode(&specs); err != nil {
+		return update, fmt.Errorf("discovery: query %s: %w", service, err)
+	}
+	update.Endpoints, err = parseEndpoints(specs)
+	if err != nil {
+		return update, fmt.Errorf("discovery: query %s: %w", service, err)
+	}
+	return update, nil
+}
+
+func (d *HTTPDiscovery) backoff(failures int) time.Duration {
+	if failures > 5 {
+		return d.retryInterval * maxHTTPRetryBackoff
+	}
+	return d.retryInterval << uint(failures)
+}
+
+// sleepContext sleep for d, return false if ctx is done before that
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
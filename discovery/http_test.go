@@ -0,0 +1,203 @@
+package discovery_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet/addresspicker"
+	"github.com/eddix/exnet/discovery"
+)
+
+// testRegistry is a registry supporting blocking queries
+type testRegistry struct {
+	mtx       sync.Mutex
+	index     uint64
+	endpoints []discovery.EndpointSpec
+	fail      bool
+	changed   chan struct{}
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{changed: make(chan struct{})}
+}
+
+func (r *testRegistry) set(index uint64, fail bool, addrs ...string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.index, r.fail, r.endpoints = index, fail, nil
+	for _, addr := range addrs {
+		r.endpoints = append(r.endpoints, discovery.EndpointSpec{Address: addr})
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/services/echo" {
+		http.NotFound(w, req)
+		return
+	}
+	index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(req.URL.Query().Get("wait"))
+
+	r.mtx.Lock()
+	if index != 0 && index == r.index {
+		changed := r.changed
+		r.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return
+		}
+		r.mtx.Lock()
+	}
+	defer r.mtx.Unlock()
+	if r.fail {
+		http.Error(w, "registry is down", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Index", strconv.FormatUint(r.index, 10))
+	_ = json.NewEncoder(w).Encode(r.endpoints)
+}
+
+func nextUpdate(t *testing.T, ch <-chan discovery.Update) discovery.Update {
+	select {
+	case u := <-ch:
+		return u
+	case <-time.After(time.Second):
+		t.Fatal("no update from discovery")
+	}
+	return discovery.Update{}
+}
+
+func TestHTTPDiscovery(t *testing.T) {
+	reg := newTestRegistry()
+	reg.set(1, false, "127.0.0.1:8001")
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	d := discovery.NewHTTPDiscovery(&discovery.HTTPConfig{
+		URL:           srv.URL + "/v1/services/",
+		Wait:          50 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := d.Subscribe(ctx, "echo")
+	assert.NoError(t, err)
+
+	u := nextUpdate(t, ch)
+	assert.NoError(t, u.Err)
+	assert.Equal(t, uint64(1), u.Index)
+	assert.Equal(t, "127.0.0.1:8001", u.Endpoints[0].Addr.String())
+
+	// blocking query returns on change
+	reg.set(2, false, "127.0.0.1:8001", "127.0.0.1:8002")
+	u = nextUpdate(t, ch)
+	assert.Equal(t, uint64(2), u.Index)
+	assert.Len(t, u.Endpoints, 2)
+
+	// errors are reported and retried
+	reg.set(3, true)
+	u = nextUpdate(t, ch)
+	assert.Error(t, u.Err)
+
+	// index goes backwards after registry restarted
+	reg.set(1, false, "127.0.0.1:8003")
+	for u = nextUpdate(t, ch); u.Err != nil; u = nextUpdate(t, ch) {
+	}
+	assert.Equal(t, uint64(1), u.Index)
+	assert.Equal(t, "127.0.0.1:8003", u.Endpoints[0].Addr.String())
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestHTTPDiscoveryRecover(t *testing.T) {
+	reg := newTestRegistry()
+	reg.set(1, false, "127.0.0.1:8001")
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	d := discovery.NewHTTPDiscovery(&discovery.HTTPConfig{
+		URL:           srv.URL + "/v1/services/",
+		Wait:          time.Second,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := d.Subscribe(ctx, "echo")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), nextUpdate(t, ch).Index)
+
+	// the update is not received before the error replaces it, and the
+	// registry recovers at the same index
+	reg.set(2, false, "127.0.0.1:8002")
+	time.Sleep(20 * time.Millisecond)
+	reg.set(2, true)
+	time.Sleep(30 * time.Millisecond)
+	reg.set(2, false, "127.0.0.1:8002")
+	u := nextUpdate(t, ch)
+	for u.Err != nil {
+		u = nextUpdate(t, ch)
+	}
+	assert.Equal(t, uint64(2), u.Index)
+	assert.Equal(t, "127.0.0.1:8002", u.Endpoints[0].Addr.String())
+}
+
+func TestFeed(t *testing.T) {
+	reg := newTestRegistry()
+	reg.set(1, false, "127.0.0.1:8001")
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	d := discovery.NewHTTPDiscovery(&discovery.HTTPConfig{
+		URL:           srv.URL + "/v1/services",
+		Wait:          50 * time.Millisecond,
+		RetryInterval: 10 * time.Millisecond,
+	})
+	rr := addresspicker.NewRoundRobin(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- discovery.Feed(ctx, d, "echo", rr)
+	}()
+
+	waitAddr := func(expect string) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if addr := pick(rr); addr == expect {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("picker is not fed with %s", expect)
+	}
+	waitAddr("127.0.0.1:8001")
+	reg.set(2, false, "127.0.0.1:8002")
+	waitAddr("127.0.0.1:8002")
+	// picker keeps last good addresses while registry is down
+	reg.set(3, true)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, "127.0.0.1:8002", pick(rr))
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func pick(rr *addresspicker.RoundRobin) string {
+	if addr := rr.Addr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
@@ -0,0 +1,245 @@
+package exnet
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+)
+
+// egressBlocked are the networks denied by EgressPolicy unless
+// EgressConfig.AllowPrivate is set. Cloud metadata endpoints, e.g.
+// 169.254.169.254, 100.100.100.200 and fd00:ec2::254, are in them.
+var egressBlocked = mustParseCIDRs(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// EgressConfig config for EgressPolicy
+type EgressConfig struct {
+	// Allow is the networks allowed, empty means all but the private ones
+	// are allowed. Networks in it are allowed even if they are private,
+	// e.g. 10.1.0.0/16 for a backend in the VPC.
+	Allow []*net.IPNet
+	// Deny is the networks denied, it takes precedence over Allow
+	Deny []*net.IPNet
+	// AllowPrivate doesn't deny private, loopback, link-local, multicast
+	// and reserved networks by default, including cloud metadata endpoints.
+	AllowPrivate bool
+	// Ports is the remote ports allowed, empty means all are allowed
+	Ports []int
+	// DenyPorts is the remote ports denied
+	DenyPorts []int
+	// AllowUnresolvedProxyTargets allows dialing host names through a
+	// proxy which resolves them, e.g. an HTTP proxy or SOCKS5 with
+	// RemoteDNS, their IPs can't be checked. Otherwise they are denied.
+	AllowUnresolvedProxyTargets bool
+}
+
+// EgressTracer interface, trace dials denied by EgressPolicy, err is an
+// *EgressError.
+type EgressTracer interface {
+	TraceEgress(network, address string, err error)
+}
+
+// TraceEgress is function implement EgressTracer interface
+type TraceEgress func(network, address string, err error)
+
+// TraceEgress implement EgressTracer interface
+func (f TraceEgress) TraceEgress(network, address string, err error) {
+	f(network, address, err)
+}
+
+// EgressPolicy denies dialing addresses by IP and port. It's checked in
+// net.Dialer.Control, after host names are resolved and right before
+// connect, so every IP dialed is checked, and a host name resolved to a
+// denied IP, e.g. by DNS rebinding, can't bypass it.
+type EgressPolicy struct {
+	// current *EgressConfig and *interface{} of tracer
+	conf   atomic.Value
+	tracer atomic.Value
+
+	metricAllowed int64
+	metricDenied  int64
+}
+
+// NewEgressPolicy create an EgressPolicy
+func NewEgressPolicy(conf *EgressConfig) *EgressPolicy {
+	if conf == nil {
+		panic("EgressConfig can't be nil")
+	}
+	p := &EgressPolicy{}
+	p.conf.Store(conf)
+	return p
+}
+
+// Update replace the config, the following dials are checked with the new
+// one, connections already dialed are kept.
+func (p *EgressPolicy) Update(conf *EgressConfig) error {
+	if conf == nil {
+		return ErrNilConfig
+	}
+	p.conf.Store(conf)
+	return nil
+}
+
+// SetTracer add a tracer to policy, it's notified of denied dials by
+// EgressTracer. It's safe to call while dialing.
+func (p *EgressPolicy) SetTracer(tracer interface{}) {
+	p.tracer.Store(&tracer)
+}
+
+// Check return an *EgressError if address, an IP and a port, is denied on
+// network. Addresses not over IP, e.g. unix sockets, are allowed.
+func (p *EgressPolicy) Check(network, address string) error {
+	if !ipNetwork(network) {
+		return nil
+	}
+	return p.result(network, address, p.deny(address))
+}
+
+// result count the check of address and trace it if it's denied for reason,
+// an empty reason means allowed
+func (p *EgressPolicy) result(network, address, reason string) error {
+	if reason == "" {
+		atomic.AddInt64(&p.metricAllowed, 1)
+		return nil
+	}
+	atomic.AddInt64(&p.metricDenied, 1)
+	err := &EgressError{Network: network, Address: address, Reason: reason}
+	if t, _ := p.tracer.Load().(*interface{}); t != nil {
+		if tracer, ok := (*t).(EgressTracer); ok {
+			tracer.TraceEgress(network, address, err)
+		}
+	}
+	return err
+}
+
+// deny return the reason if address is denied, empty if allowed
+func (p *EgressPolicy) deny(address string) string {
+	host, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "invalid address"
+	}
+	// the zone of IPv6 link-local addresses, e.g. fe80::1%eth0
+	for i := 0; i < len(host); i++ {
+		if host[i] == '%' {
+			host = host[:i]
+			break
+		}
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portstr)
+	if ip == nil || err != nil {
+		return "invalid address"
+	}
+	conf := p.conf.Load().(*EgressConfig)
+	if containsPort(conf.DenyPorts, port) ||
+		(len(conf.Ports) > 0 && !containsPort(conf.Ports, port)) {
+		return "port not allowed"
+	}
+	if containsIP(conf.Deny, ip) {
+		return "network denied"
+	}
+	if containsIP(conf.Allow, ip) {
+		return ""
+	}
+	if len(conf.Allow) > 0 {
+		return "network not allowed"
+	}
+	if !conf.AllowPrivate && containsIP(egressBlocked, ip) {
+		return "private network"
+	}
+	return ""
+}
+
+// control return a net.Dialer.Control checking the address before connect,
+// and calling next after it if next is not nil.
+func (p *EgressPolicy) control(next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := p.Check(network, address); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(network, address, c)
+		}
+		return nil
+	}
+}
+
+// checkTarget check the target of a proxied dial, a host name resolved by
+// the proxy is denied unless AllowUnresolvedProxyTargets is set
+func (p *EgressPolicy) checkTarget(target net.Addr) error {
+	addr, ok := target.(*net.TCPAddr)
+	if !ok {
+		reason := "host name resolved by proxy"
+		if p.conf.Load().(*EgressConfig).AllowUnresolvedProxyTargets {
+			reason = ""
+		}
+		return p.result(target.Network(), target.String(), reason)
+	}
+	network := "tcp6"
+	if addr.IP.To4() != nil {
+		network = "tcp4"
+	}
+	return p.Check(network, addr.String())
+}
+
+// Metrics return the numbers of addresses allowed and denied
+func (p *EgressPolicy) Metrics() map[string]int64 {
+	return map[string]int64{
+		"allowed": atomic.LoadInt64(&p.metricAllowed),
+		"denied":  atomic.LoadInt64(&p.metricDenied),
+	}
+}
+
+// SetEgressPolicy check every IP dialed with p, including the addresses
+// resolved from host names, and the proxy of SetProxy. Through a proxy, the
+// target is checked too if it's an IP or resolved locally, host names
+// resolved by the proxy can't be checked, and they are denied unless
+// EgressConfig.AllowUnresolvedProxyTargets is set. nil removes the policy.
+func (d *Dialer) SetEgressPolicy(p *EgressPolicy) {
+	d.egress = p
+}
+
+// egressDenied return the *EgressError in err if any, so it's not wrapped
+// by net.OpError
+func egressDenied(err error) error {
+	var eerr *EgressError
+	if err != nil && errors.As(err, &eerr) {
+		return eerr
+	}
+	return err
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
@@ -0,0 +1,175 @@
+package exnet_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func TestEgressPolicyCheck(t *testing.T) {
+	private, _ := exnet.ParseCIDRs("10.1.0.0/16")
+	denied, _ := exnet.ParseCIDRs("10.1.2.0/24", "8.8.4.4")
+	cases := []struct {
+		conf    *exnet.EgressConfig
+		network string
+		address string
+		allowed bool
+	}{
+		{&exnet.EgressConfig{}, "tcp4", "8.8.8.8:443", true},
+		{&exnet.EgressConfig{}, "tcp4", "127.0.0.1:80", false},
+		{&exnet.EgressConfig{}, "tcp4", "10.0.0.1:80", false},
+		{&exnet.EgressConfig{}, "tcp4", "192.168.1.1:80", false},
+		{&exnet.EgressConfig{}, "tcp4", "169.254.169.254:80", false},
+		{&exnet.EgressConfig{}, "tcp4", "100.100.100.200:80", false},
+		{&exnet.EgressConfig{}, "tcp4", "0.0.0.0:80", false},
+		{&exnet.EgressConfig{}, "tcp6", "[::1]:80", false},
+		{&exnet.EgressConfig{}, "tcp6", "[::ffff:10.0.0.1]:80", false},
+		{&exnet.EgressConfig{}, "tcp6", "[fd00:ec2::254]:80", false},
+		{&exnet.EgressConfig{}, "tcp6", "[fe80::1%lo]:80", false},
+		{&exnet.EgressConfig{}, "tcp6", "[2001:4860:4860::8888]:443", true},
+		{&exnet.EgressConfig{}, "unix", "/tmp/egress.sock", true},
+		{&exnet.EgressConfig{AllowPrivate: true}, "tcp4", "127.0.0.1:80", true},
+		{&exnet.EgressConfig{Allow: private}, "tcp4", "10.1.0.1:80", true},
+		{&exnet.EgressConfig{Allow: private}, "tcp4", "8.8.8.8:80", false},
+		{&exnet.EgressConfig{Allow: private, Deny: denied}, "tcp4", "10.1.2.1:80", false},
+		{&exnet.EgressConfig{Deny: denied}, "tcp4", "8.8.4.4:53", false},
+		{&exnet.EgressConfig{Ports: []int{80, 443}}, "tcp4", "8.8.8.8:443", true},
+		{&exnet.EgressConfig{Ports: []int{80, 443}}, "tcp4", "8.8.8.8:22", false},
+		{&exnet.EgressConfig{DenyPorts: []int{25}}, "tcp4", "8.8.8.8:25", false},
+	}
+	for _, c := range cases {
+		err := exnet.NewEgressPolicy(c.conf).Check(c.network, c.address)
+		if c.allowed {
+			assert.NoError(t, err, "%s %s", c.network, c.address)
+			continue
+		}
+		var eerr *exnet.EgressError
+		if assert.True(t, errors.As(err, &eerr), "%s %s: %v", c.network, c.address, err) {
+			assert.Equal(t, c.address, eerr.Address)
+			assert.True(t, errors.Is(err, exnet.ErrEgressDenied))
+		}
+	}
+}
+
+func TestEgressPolicySetTracer(t *testing.T) {
+	p := exnet.NewEgressPolicy(&exnet.EgressConfig{})
+	p.SetTracer(exnet.TraceEgress(func(string, string, error) {}))
+
+	// run with -race, the tracer can be replaced while checking
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Error(t, p.Check("tcp", "127.0.0.1:80"))
+		}()
+	}
+	p.SetTracer(nil)
+	wg.Wait()
+	assert.Equal(t, int64(4), p.Metrics()["denied"])
+}
+
+func TestDialEgressDenied(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	var traced []string
+	p := exnet.NewEgressPolicy(&exnet.EgressConfig{})
+	p.SetTracer(exnet.TraceEgress(func(network, address string, err error) {
+		traced = append(traced, network+" "+address)
+	}))
+	d := &exnet.Dialer{}
+	d.SetEgressPolicy(p)
+	_, err := d.Dial("tcp", echo.Addr().String())
+	var eerr *exnet.EgressError
+	if assert.True(t, errors.As(err, &eerr), "%v", err) {
+		assert.Equal(t, "private network", eerr.Reason)
+	}
+	assert.Equal(t, []string{"tcp4 " + echo.Addr().String()}, traced)
+
+	// a host name resolved to a denied IP is checked after resolution
+	tr := &testResolver{hosts: map[string][]string{"rebind.test": {"127.0.0.1"}}}
+	d.SetResolver(tr)
+	_, err = d.Dial("tcp", net.JoinHostPort("rebind.test", port))
+	assert.True(t, errors.Is(err, exnet.ErrEgressDenied), "%v", err)
+
+	loopback, _ := exnet.ParseCIDRs("127.0.0.0/8")
+	assert.NoError(t, p.Update(&exnet.EgressConfig{Allow: loopback}))
+	conn, err := d.Dial("tcp", net.JoinHostPort("rebind.test", port))
+	if assert.NoError(t, err) {
+		assertEcho(t, conn, "")
+		conn.Close()
+	}
+	assert.NoError(t, p.Update(&exnet.EgressConfig{Allow: loopback, DenyPorts: []int{echo.Addr().(*net.TCPAddr).Port}}))
+	_, err = d.Dial("tcp", echo.Addr().String())
+	assert.True(t, errors.Is(err, exnet.ErrEgressDenied), "%v", err)
+	assert.Equal(t, map[string]int64{"allowed": 1, "denied": 3}, p.Metrics())
+	assert.Len(t, traced, 3)
+
+	// the target of a proxy is checked if it's an IP
+	proxy := newTestProxy(t, serveSOCKS5)
+	defer proxy.Close()
+	conf, err := exnet.ParseProxyURL("socks5://" + proxy.Addr().String())
+	assert.NoError(t, err)
+	d.SetProxy(conf)
+	assert.NoError(t, p.Update(&exnet.EgressConfig{Allow: loopback, DenyPorts: []int{echo.Addr().(*net.TCPAddr).Port}}))
+	_, err = d.Dial("tcp", echo.Addr().String())
+	assert.True(t, errors.Is(err, exnet.ErrEgressDenied), "%v", err)
+
+	// a host name resolved by the proxy is denied unless it's allowed
+	proxy.hosts["echo.test"] = "127.0.0.1"
+	conf, err = exnet.ParseProxyURL("socks5h://" + proxy.Addr().String())
+	assert.NoError(t, err)
+	d.SetProxy(conf)
+	assert.NoError(t, p.Update(&exnet.EgressConfig{Allow: loopback}))
+	_, err = d.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if assert.True(t, errors.As(err, &eerr), "%v", err) {
+		assert.Equal(t, "host name resolved by proxy", eerr.Reason)
+	}
+	assert.Len(t, proxy.targets, 0)
+	assert.NoError(t, p.Update(&exnet.EgressConfig{Allow: loopback, AllowUnresolvedProxyTargets: true}))
+	conn, err = d.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if assert.NoError(t, err) {
+		assert.Equal(t, net.JoinHostPort("echo.test", port), <-proxy.targets)
+		assertEcho(t, conn, "")
+		conn.Close()
+	}
+}
+
+func TestDialEgressBeforeSocketOptions(t *testing.T) {
+	d := &exnet.Dialer{}
+	d.SetEgressPolicy(exnet.NewEgressPolicy(&exnet.EgressConfig{}))
+	// the option is invalid, the policy is checked before it's set
+	d.SetSocketOptions(&exnet.SocketOptions{KeepCount: 1000})
+	_, err := d.Dial("tcp", "127.0.0.1:1")
+	assert.True(t, errors.Is(err, exnet.ErrEgressDenied), "%v", err)
+}
+
+func TestClusterEgressDenied(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", echo.Addr().String()))
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		AddressPicker: ap,
+		Egress:        exnet.NewEgressPolicy(&exnet.EgressConfig{}),
+	})
+	_, err := cluster.Dial("", "")
+	assert.True(t, errors.Is(err, exnet.ErrEgressDenied), "%v", err)
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_egress_denied"])
+
+	conf := cluster.Config()
+	conf.Egress = nil
+	assert.NoError(t, cluster.Update(conf))
+	conn, err := cluster.Dial("", "")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
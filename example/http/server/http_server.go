@@ -14,13 +14,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	l.SetTimeouts(&exnet.TimeoutConfig{
+		IdleTimeout:  10 * time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
 	l.SetAcceptCallback(func(conn net.Conn) error {
-		_ = exnet.TraceConn(conn, nil)
-		_ = conn.SetDeadline(time.Now().Add(time.Second))
-		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
-		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
-		_ = exnet.Freeze(conn)
-		return nil
+		return exnet.TraceConn(conn, nil)
 	})
 	panic(http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "hello world")
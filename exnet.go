@@ -1,10 +1,142 @@
 package exnet
 
-import "errors"
+import (
+	"errors"
+	"net"
+	"time"
+)
 
 var (
 	// ErrNotExnetConn if a net.Conn is not a exnet.Conn
 	ErrNotExnetConn = errors.New("Not an ExNet Connection")
 	// ErrFreezeExnetConn if a net.Conn is freezed
 	ErrFreezeExnetConn = errors.New("Freezed exnet.Conn")
+	// ErrNoAddressPicker if a Cluster has no AddressPicker
+	ErrNoAddressPicker = errors.New("Cluster has no AddressPicker")
+	// ErrNoAddress if AddressPicker of a Cluster has no address
+	ErrNoAddress = errors.New("AddressPicker has no address")
+	// ErrNilConfig if a config is nil
+	ErrNilConfig = errors.New("Config can't be nil")
+	// ErrListenerShutdown if Accept on a Listener which is shutting down
+	ErrListenerShutdown = errors.New("Listener is shutting down")
+	// ErrTooManyConns if a Listener has too many active connections
+	ErrTooManyConns = errors.New("Too many connections")
+	// ErrTooManyConnsPerIP if a Listener has too many active connections
+	// from a source IP
+	ErrTooManyConnsPerIP = errors.New("Too many connections from the IP")
+	// ErrDenied if a connection is denied by CIDRPolicy
+	ErrDenied = errors.New("Connection denied")
+	// ErrRateLimited if a connection is rejected by RateLimitPolicy, or a
+	// dial is over the rate limits of Cluster
+	ErrRateLimited = errors.New("Connection rate limited")
+	// ErrNoProxyHeader if a connection doesn't start with a PROXY header
+	ErrNoProxyHeader = errors.New("No PROXY protocol header")
+	// ErrInvalidProxyHeader if a PROXY header is malformed
+	ErrInvalidProxyHeader = errors.New("Invalid PROXY protocol header")
+	// ErrNoProtocolMatch if a connection is matched by no child of Mux
+	ErrNoProtocolMatch = errors.New("No protocol matched")
+	// ErrSockOptNotSupported if a socket option is not supported on the
+	// platform
+	ErrSockOptNotSupported = errors.New("Socket option not supported")
+	// ErrNoListenerFile if the underlying listener of a Listener has no file
+	ErrNoListenerFile = errors.New("Listener has no file")
+	// ErrNotUnixConn if a net.Conn is not over a unix socket
+	ErrNotUnixConn = errors.New("Not a unix connection")
+	// ErrProxyAuth if a proxy rejects the credentials, or requires them
+	ErrProxyAuth = errors.New("Proxy authentication failed")
+	// ErrInvalidProxyResponse if a proxy responds not in its protocol
+	ErrInvalidProxyResponse = errors.New("Invalid proxy response")
+	// ErrEgressDenied if a dial is denied by EgressPolicy
+	ErrEgressDenied = errors.New("Egress denied")
 )
+
+// AcceptError is a connection rejected by Listener, it's a temporary
+// net.Error, as the listener still works.
+type AcceptError struct {
+	Err        error
+	RemoteAddr net.Addr
+}
+
+var _ net.Error = &AcceptError{}
+
+func (e *AcceptError) Error() string {
+	return "accept " + e.RemoteAddr.String() + ": " + e.Err.Error()
+}
+
+// Unwrap return the reason of rejection
+func (e *AcceptError) Unwrap() error { return e.Err }
+
+// Timeout is always false
+func (e *AcceptError) Timeout() bool { return false }
+
+// Temporary is always true
+func (e *AcceptError) Temporary() bool { return true }
+
+// AddrNotAvailableError is a dial failed with EADDRNOTAVAIL, usually the
+// local ports to the address are exhausted, or a local IP bound is not
+// available. It's a temporary net.Error.
+type AddrNotAvailableError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+var _ net.Error = &AddrNotAvailableError{}
+
+func (e *AddrNotAvailableError) Error() string {
+	return "dial " + e.Network + " " + e.Address + ": local address not available: " + e.Err.Error()
+}
+
+// Unwrap return the underlying error
+func (e *AddrNotAvailableError) Unwrap() error { return e.Err }
+
+// Timeout is always false
+func (e *AddrNotAvailableError) Timeout() bool { return false }
+
+// Temporary is always true
+func (e *AddrNotAvailableError) Temporary() bool { return true }
+
+// EgressError is a dial denied by EgressPolicy, Address is the IP and port
+// denied, which may be resolved from the address dialed.
+type EgressError struct {
+	Network string
+	Address string
+	Reason  string
+}
+
+var _ net.Error = &EgressError{}
+
+func (e *EgressError) Error() string {
+	return "dial " + e.Network + " " + e.Address + ": " + ErrEgressDenied.Error() + ": " + e.Reason
+}
+
+// Unwrap return ErrEgressDenied
+func (e *EgressError) Unwrap() error { return ErrEgressDenied }
+
+// Timeout is always false
+func (e *EgressError) Timeout() bool { return false }
+
+// Temporary is always false
+func (e *EgressError) Temporary() bool { return false }
+
+// DialRateLimitError is a dial over the rate limits of Cluster, Wait is the
+// duration until it would be allowed. It's a temporary net.Error.
+type DialRateLimitError struct {
+	Address string
+	Wait    time.Duration
+}
+
+var _ net.Error = &DialRateLimitError{}
+
+func (e *DialRateLimitError) Error() string {
+	return "dial " + e.Address + ": " + ErrRateLimited.Error() + ", retry after " + e.Wait.String()
+}
+
+// Unwrap return ErrRateLimited
+func (e *DialRateLimitError) Unwrap() error { return ErrRateLimited }
+
+// Timeout is always false
+func (e *DialRateLimitError) Timeout() bool { return false }
+
+// Temporary is always true
+func (e *DialRateLimitError) Temporary() bool { return true }
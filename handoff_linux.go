@@ -0,0 +1,206 @@
+//go:build linux
+// +build linux
+
+package exnet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// InheritFDsEnv is the environment variable of listening sockets passed
+	// by PassListeners, the value is a comma separated list of fds.
+	InheritFDsEnv = "EXNET_INHERIT_FDS"
+
+	// first fd passed by systemd
+	systemdFDStart = 3
+	// SCM_MAX_FD of the kernel, it fits in the byte of count sent by
+	// SendListeners
+	maxSendListeners = 253
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// File return a duplicate of the listening socket, it's a blocking file,
+// the caller should close it after passing it.
+func (l *Listener) File() (*os.File, error) {
+	f, ok := l._l.(filer)
+	if !ok {
+		return nil, ErrNoListenerFile
+	}
+	return f.File()
+}
+
+// PassListeners pass listening sockets to the process started by cmd, the
+// child process gets them by InheritedListeners. They are appended to
+// cmd.ExtraFiles, and cmd.Env is set to the environment of current process
+// if it's nil. The caller should close cmd.ExtraFiles after cmd.Start,
+// listeners keep working, so the current process can drain connections by
+// Shutdown after the child process starts accepting. cmd is not changed if
+// an error is returned.
+func PassListeners(cmd *exec.Cmd, ls ...*Listener) error {
+	fds := make([]string, 0, len(ls))
+	n := len(cmd.ExtraFiles)
+	for _, l := range ls {
+		f, err := l.File()
+		if err != nil {
+			for _, f := range cmd.ExtraFiles[n:] {
+				_ = f.Close()
+			}
+			cmd.ExtraFiles = cmd.ExtraFiles[:n]
+			return err
+		}
+		// fd 0-2 are stdin, stdout and stderr
+		fds = append(fds, strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, InheritFDsEnv+"="+strings.Join(fds, ","))
+	return nil
+}
+
+// InheritedListeners return listening sockets passed by systemd socket
+// activation (LISTEN_FDS) or PassListeners, nil if there is none. The
+// environment variables are unset, so they are not passed to child
+// processes again.
+func InheritedListeners() ([]*Listener, error) {
+	fds, err := inheritedFDs()
+	if err != nil || len(fds) == 0 {
+		return nil, err
+	}
+	ls := make([]*Listener, 0, len(fds))
+	for _, fd := range fds {
+		l, err := fileListener(os.NewFile(uintptr(fd), "listener:"+strconv.Itoa(fd)))
+		if err != nil {
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// inheritedFDs return fds from environment variables and unset them
+func inheritedFDs() ([]int, error) {
+	if v := os.Getenv(InheritFDsEnv); v != "" {
+		_ = os.Unsetenv(InheritFDsEnv)
+		var fds []int
+		for _, s := range strings.Split(v, ",") {
+			fd, err := strconv.Atoi(s)
+			if err != nil || fd < 3 {
+				return nil, fmt.Errorf("Invalid %s %q", InheritFDsEnv, v)
+			}
+			fds = append(fds, fd)
+		}
+		return fds, nil
+	}
+
+	pid, n := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if n == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	// passed to another process
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS %q", n)
+	}
+	fds := make([]int, count)
+	for i := range fds {
+		fds[i] = systemdFDStart + i
+		syscall.CloseOnExec(fds[i])
+	}
+	return fds, nil
+}
+
+// SendListeners send listening sockets over a unix socket, the receiver
+// gets them by ReceiveListeners in order. At most 253 listeners can be sent
+// at once, the limit of the kernel.
+func SendListeners(conn *net.UnixConn, ls ...*Listener) error {
+	if len(ls) > maxSendListeners {
+		return fmt.Errorf("Too many listeners %d, at most %d can be sent", len(ls), maxSendListeners)
+	}
+	fds := make([]int, 0, len(ls))
+	for _, l := range ls {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+	// the count is sent as data, at least a byte is required
+	_, _, err := conn.WriteMsgUnix([]byte{byte(len(fds))}, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// ReceiveListeners receive listening sockets sent by SendListeners
+func ReceiveListeners(conn *net.UnixConn) ([]*Listener, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(maxSendListeners*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	ls := make([]*Listener, 0, len(fds))
+	for i, fd := range fds {
+		syscall.CloseOnExec(fd)
+		l, err := fileListener(os.NewFile(uintptr(fd), "listener:"+strconv.Itoa(fd)))
+		if err != nil {
+			for _, fd := range fds[i+1:] {
+				_ = syscall.Close(fd)
+			}
+			for _, l := range ls {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if len(ls) != int(buf[0]) {
+		for _, l := range ls {
+			_ = l.Close()
+		}
+		return nil, fmt.Errorf("Received %d listeners, %d expected", len(ls), buf[0])
+	}
+	return ls, nil
+}
+
+// fileListener create a Listener from f and close f
+func fileListener(f *os.File) (*Listener, error) {
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{_l: l}, nil
+}
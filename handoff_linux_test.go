@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package exnet_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+)
+
+const handoffEnv = "EXNET_TEST_HANDOFF"
+
+// TestHandoffChild is run in child processes started by handoff tests, it
+// serves a connection on every inherited listener.
+func TestHandoffChild(t *testing.T) {
+	mode := os.Getenv(handoffEnv)
+	if mode == "" {
+		t.Skip("run by handoff tests")
+	}
+	var ls []*exnet.Listener
+	var err error
+	switch mode {
+	case "systemd":
+		// systemd sets it to the pid after fork
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		ls, err = exnet.InheritedListeners()
+		assert.Empty(t, os.Getenv("LISTEN_FDS"))
+	case "exec":
+		ls, err = exnet.InheritedListeners()
+		assert.Empty(t, os.Getenv(exnet.InheritFDsEnv))
+	default:
+		var conn net.Conn
+		conn, err = net.Dial("unix", mode)
+		if assert.NoError(t, err) {
+			ls, err = exnet.ReceiveListeners(conn.(*net.UnixConn))
+			conn.Close()
+		}
+	}
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, ls) {
+		return
+	}
+	for i, l := range ls {
+		conn, err := l.Accept()
+		if assert.NoError(t, err) {
+			_, _ = conn.Write([]byte("child" + strconv.Itoa(i)))
+			conn.Close()
+		}
+		l.Close()
+	}
+}
+
+func handoffCmd(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoffChild$")
+	cmd.Env = append(os.Environ(), handoffEnv+"="+mode)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// assertChildServes check listeners are served by the child process
+func assertChildServes(t *testing.T, cmd *exec.Cmd, ls ...*exnet.Listener) {
+	for i, l := range ls {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			continue
+		}
+		data, err := ioutil.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "child"+strconv.Itoa(i), string(data))
+		conn.Close()
+	}
+	assert.NoError(t, cmd.Wait())
+}
+
+func listenN(t *testing.T, n int) []*exnet.Listener {
+	var ls []*exnet.Listener
+	for i := 0; i < n; i++ {
+		l, err := exnet.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+func TestPassListeners(t *testing.T) {
+	ls := listenN(t, 2)
+	cmd := handoffCmd("exec")
+	// an unrelated file before listeners
+	devnull, err := os.Open(os.DevNull)
+	assert.NoError(t, err)
+	cmd.ExtraFiles = []*os.File{devnull}
+	assert.NoError(t, exnet.PassListeners(cmd, ls...))
+	assert.NoError(t, cmd.Start())
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	// the parent stops accepting, connections go to the child
+	for _, l := range ls {
+		l.Close()
+	}
+	assertChildServes(t, cmd, ls...)
+}
+
+func TestPassListenersError(t *testing.T) {
+	ls := listenN(t, 1)
+	defer ls[0].Close()
+	// a listener without file fails in the middle
+	ls = append(ls, exnet.WithListener(&tempErrListener{Listener: ls[0]}))
+	cmd := handoffCmd("exec")
+	env := cmd.Env
+	assert.Equal(t, exnet.ErrNoListenerFile, exnet.PassListeners(cmd, ls...))
+	assert.Len(t, cmd.ExtraFiles, 0)
+	assert.Equal(t, env, cmd.Env)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	ls := listenN(t, 2)
+	cmd := handoffCmd("systemd")
+	for _, l := range ls {
+		f, err := l.File()
+		assert.NoError(t, err)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		l.Close()
+	}
+	cmd.Env = append(cmd.Env, "LISTEN_FDS=2")
+	assert.NoError(t, cmd.Start())
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	assertChildServes(t, cmd, ls...)
+}
+
+func TestSendListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+	ul, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	defer ul.Close()
+
+	ls := listenN(t, 2)
+	cmd := handoffCmd(path)
+	assert.NoError(t, cmd.Start())
+	conn, err := ul.Accept()
+	if assert.NoError(t, err) {
+		assert.NoError(t, exnet.SendListeners(conn.(*net.UnixConn), ls...))
+		conn.Close()
+	}
+	for _, l := range ls {
+		l.Close()
+	}
+	assertChildServes(t, cmd, ls...)
+}
+
+func TestSendListenersTooMany(t *testing.T) {
+	ls := make([]*exnet.Listener, 254)
+	err := exnet.SendListeners(nil, ls...)
+	assert.EqualError(t, err, "Too many listeners 254, at most 253 can be sent")
+}
+
+func TestInheritedListenersNone(t *testing.T) {
+	ls, err := exnet.InheritedListeners()
+	assert.NoError(t, err)
+	assert.Nil(t, ls)
+}
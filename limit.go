@@ -0,0 +1,137 @@
+package exnet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnLimitConfig config for connection limits of Listener
+type ConnLimitConfig struct {
+	// MaxConns is the max number of active connections, 0 means no limit
+	MaxConns int
+	// MaxConnsPerIP is the max number of active connections from a source
+	// IP, 0 means no limit. Connections over it are always rejected, as
+	// waiting for a single source would block all others.
+	MaxConnsPerIP int
+	// Reject closes connections over MaxConns right after accepted,
+	// otherwise Accept blocks until an active connection is closed, and new
+	// connections wait in the backlog of the socket.
+	Reject bool
+}
+
+// RejectTracer interface, trace connections rejected by listener
+type RejectTracer interface {
+	TraceReject(conn net.Conn, err error)
+}
+
+// TraceReject is function implement RejectTracer interface
+type TraceReject func(conn net.Conn, err error)
+
+// TraceReject implement RejectTracer interface
+func (f TraceReject) TraceReject(conn net.Conn, err error) {
+	f(conn, err)
+}
+
+// SetConnLimit limit active connections of listener, rejected connections
+// are traced by RejectTracer and counted in Metrics. nil disables limits.
+func (l *Listener) SetConnLimit(conf *ConnLimitConfig) {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+	l.connLimit = conf
+	l.slotCond().Broadcast()
+}
+
+// slotCond return the condition signaled when a connection is closed, the
+// caller must hold connsMtx.
+func (l *Listener) slotCond() *sync.Cond {
+	if l.slotc == nil {
+		l.slotc = sync.NewCond(&l.connsMtx)
+	}
+	return l.slotc
+}
+
+// waitSlot blocks until a connection can be accepted under MaxConns, and
+// reserves it. Return false if no slot is reserved.
+func (l *Listener) waitSlot() bool {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+
+	for {
+		conf := l.connLimit
+		if conf == nil || conf.MaxConns <= 0 || conf.Reject {
+			return false
+		}
+		if atomic.LoadInt32(&l.shutdown) != 0 || atomic.LoadInt32(&l.closed) != 0 {
+			return false
+		}
+		if len(l.conns)+l.reserved < conf.MaxConns {
+			l.reserved++
+			return true
+		}
+		l.slotCond().Wait()
+	}
+}
+
+// releaseSlot release a slot reserved by waitSlot
+func (l *Listener) releaseSlot(reserved bool) {
+	if !reserved {
+		return
+	}
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+	l.reserved--
+	l.slotCond().Broadcast()
+}
+
+// checkLimit return an error if c exceeds the limits, caller must hold
+// connsMtx.
+func (l *Listener) checkLimit(c *Conn, reserved bool) error {
+	conf := l.connLimit
+	if conf == nil {
+		return nil
+	}
+	if conf.MaxConns > 0 && !reserved && len(l.conns)+l.reserved >= conf.MaxConns {
+		atomic.AddInt64(&l.metricRejectedMaxConns, 1)
+		return ErrTooManyConns
+	}
+	if ip := connIP(c); ip != "" && conf.MaxConnsPerIP > 0 && l.connsPerIP[ip] >= conf.MaxConnsPerIP {
+		atomic.AddInt64(&l.metricRejectedPerIP, 1)
+		return ErrTooManyConnsPerIP
+	}
+	return nil
+}
+
+// reject close c, trace it and send it to the reject channel
+func (l *Listener) reject(c *Conn, err error) {
+	if tracer, ok := l.loadTracer().(RejectTracer); ok {
+		tracer.TraceReject(c, err)
+	}
+	if ch := l.rejectch; ch != nil {
+		select {
+		case ch <- &AcceptError{Err: err, RemoteAddr: c.RemoteAddr()}:
+		default:
+		}
+	}
+	_ = c.Close()
+}
+
+// connIP return the source IP of c, the one in PROXY header if any
+func connIP(c *Conn) string {
+	if ip := addrIP(c.RemoteAddr()); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Metrics of listener
+func (l *Listener) Metrics() map[string]int64 {
+	return map[string]int64{
+		"accepted":           atomic.LoadInt64(&l.metricAccepted),
+		"active":             int64(l.activeCount()),
+		"rejected_max_conns": atomic.LoadInt64(&l.metricRejectedMaxConns),
+		"rejected_per_ip":    atomic.LoadInt64(&l.metricRejectedPerIP),
+		"rejected_policy":    atomic.LoadInt64(&l.metricRejectedPolicy),
+		"rejected_callback":  atomic.LoadInt64(&l.metricRejectedCallback),
+	}
+}
@@ -0,0 +1,79 @@
+package exnet
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ListenConfig contains options for listening, socket options are applied
+// on Linux only, Listen returns ErrSockOptNotSupported on other platforms if
+// any of them is set.
+type ListenConfig struct {
+	// ReusePort sets SO_REUSEPORT, so processes can listen on the same
+	// address, and the kernel balances connections among them.
+	ReusePort bool
+	// Backlog is the max length of the queue of pending connections, 0 is
+	// the system default, net.core.somaxconn caps it.
+	Backlog int
+	// DeferAccept sets TCP_DEFER_ACCEPT, a connection is accepted after
+	// data arrives or the duration expires, it's rounded up to seconds.
+	DeferAccept time.Duration
+	// FastOpen sets TCP_FASTOPEN to the max length of the queue of pending
+	// TFO requests, 0 disables it.
+	FastOpen int
+	// KeepAlive is passed to net.ListenConfig, it's overridden by
+	// TCPOptions if set.
+	KeepAlive time.Duration
+	// TCPOptions set on every accepted tcp connection, nil means the
+	// options of net.ListenConfig.
+	TCPOptions *TCPOptions
+}
+
+// Listen works like net.ListenConfig.Listen, but return an exnet.Listener
+// whose socket options are set by lc.
+func (lc *ListenConfig) Listen(ctx context.Context, network, addr string) (*Listener, error) {
+	nlc := &net.ListenConfig{KeepAlive: lc.KeepAlive}
+	if lc.needControl() {
+		nlc.Control = lc.control
+	}
+	l, err := nlc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Backlog > 0 {
+		if err := setBacklog(l, lc.Backlog); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+	el := &Listener{_l: l}
+	el.SetTCPOptions(lc.TCPOptions)
+	return el, nil
+}
+
+func (lc *ListenConfig) needControl() bool {
+	return lc.ReusePort || lc.DeferAccept > 0 || lc.FastOpen > 0
+}
+
+// SetTCPOptions set options on every accepted tcp connection before PROXY
+// header and TLS handshake, connections failed are rejected. nil disables
+// it.
+func (l *Listener) SetTCPOptions(o *TCPOptions) {
+	l.tcpOptions = o
+}
+
+// SockOptError is an error of setting or getting a socket option
+type SockOptError struct {
+	Option string
+	Err    error
+}
+
+func (e *SockOptError) Error() string {
+	return "Socket option " + e.Option + ": " + e.Err.Error()
+}
+
+// Unwrap return the underlying error
+func (e *SockOptError) Unwrap() error {
+	return e.Err
+}
@@ -1,18 +1,79 @@
 package exnet
 
 import (
+	"crypto/tls"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
 // Listener listen and return a exnet.Conn
 type Listener struct {
 	_l net.Listener
 
 	_acceptCallback func(net.Conn) error
+
+	// current *interface{}, *tls.Config and *TimeoutConfig, they are read
+	// by connections being prepared, and can be changed while accepting
+	tracer           atomic.Value
+	tlsConfig        atomic.Value
+	timeouts         atomic.Value
+	handshakeTimeout int64
+	proxyProtocol    *ProxyProtocolConfig
+	tcpOptions       *TCPOptions
+
+	// accepted connections not closed yet, and ones being prepared in
+	// background
+	connsMtx       sync.Mutex
+	conns          map[*Conn]struct{}
+	preparing      map[net.Conn]struct{}
+	connsPerIP     map[string]int
+	shutdown       int32
+	closed         int32
+	shutdownSignal func(net.Conn)
+
+	// connection limits, slotc is signaled when a connection is closed
+	connLimit *ConnLimitConfig
+	slotc     *sync.Cond
+	reserved  int
+
+	// current *AcceptPolicy
+	policy atomic.Value
+	// replay wraps accepted connections in replayConn for Mux
+	replay bool
+
+	// connections prepared in background, see SetTLSConfig. acceptDone is
+	// closed with acceptErr when the underlying listener fails. tls is set
+	// if TLS is enabled at the first Accept.
+	prepareOnce sync.Once
+	tls         bool
+	preparedc   chan preparedConn
+	acceptDone  chan struct{}
+	acceptErr   error
+
+	// metrics
+	metricAccepted         int64
+	metricRejectedMaxConns int64
+	metricRejectedPerIP    int64
+	metricRejectedPolicy   int64
+	metricRejectedCallback int64
+
+	rejectch chan<- error
 }
 
 var _ net.Listener = &Listener{}
 
+// preparedConn is a connection prepared in background, or an error of the
+// underlying listener
+type preparedConn struct {
+	c        *Conn
+	reserved bool
+	err      error
+}
+
 // WithListener return an exnet.Listener with an underlying net.Listener,
 // if l is already an exnet.Listener, return its-self.
 func WithListener(l net.Listener) *Listener {
@@ -31,38 +92,326 @@ func Listen(network, addr string) (*Listener, error) {
 	return &Listener{_l: l}, nil
 }
 
+// ListenTLS works like tls.Listen, but return an exnet.Listener whose
+// accepted connections are exnet.Conn over TLS, see SetTLSConfig.
+func ListenTLS(network, addr string, conf *tls.Config) (*Listener, error) {
+	l, err := Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l.SetTLSConfig(conf)
+	return l, nil
+}
+
 // Underlying return underlying net.Listener
 func (l *Listener) Underlying() net.Listener {
 	return l._l
 }
 
 // SetAcceptCallback add an accept callback to every new connection
-// when it's accepted
+// when it's accepted, the connection is rejected if callback return error.
 func (l *Listener) SetAcceptCallback(f func(net.Conn) error) {
 	l._acceptCallback = f
 }
 
+// SetTracer add a tracer to listener, it's notified of events of the
+// listener, e.g. TLS handshakes by HandshakeTracer. It's safe to call while
+// accepting.
+func (l *Listener) SetTracer(tracer interface{}) {
+	l.tracer.Store(&tracer)
+}
+
+// loadTracer return the current tracer or nil
+func (l *Listener) loadTracer() interface{} {
+	if t, _ := l.tracer.Load().(*interface{}); t != nil {
+		return *t
+	}
+	return nil
+}
+
+// SetTLSConfig terminate TLS on accepted connections, the handshake is done
+// in background for every connection, so a slow client doesn't hold up
+// others, and Accept returns the connections handshaked. The accept
+// callback runs after the handshake, so it can check the peer by
+// TLSConnectionState or PeerIdentity. Set conf.ClientAuth and ClientCAs to
+// verify client certificates, and conf.GetCertificate to a CertReloader to
+// reload certificates without restart. TLS must be set before the first
+// Accept, conf can be replaced while accepting, and the following
+// handshakes use the new one, but nil fails them instead of disabling TLS.
+func (l *Listener) SetTLSConfig(conf *tls.Config) {
+	l.tlsConfig.Store(conf)
+}
+
+// loadTLSConfig return the current TLS config or nil
+func (l *Listener) loadTLSConfig() *tls.Config {
+	conf, _ := l.tlsConfig.Load().(*tls.Config)
+	return conf
+}
+
+// SetTLSHandshakeTimeout change the max duration of TLS handshakes,
+// default is 10 seconds. It's safe to call while accepting.
+func (l *Listener) SetTLSHandshakeTimeout(d time.Duration) {
+	atomic.StoreInt64(&l.handshakeTimeout, int64(d))
+}
+
+// SetProxyProtocol parse PROXY protocol v1 or v2 header on connections
+// accepted from trusted upstreams, RemoteAddr and LocalAddr of the
+// connections are the client addresses in the header. The header is read
+// in background before TLS handshake, like the handshake, and the callback
+// can get it by ProxyHeaderOf. nil disables PROXY protocol, it must be set
+// before the first Accept.
+//
+// Optional mode looks for a header in the first bytes sent by client, so it
+// only works with protocols in which clients speak first.
+func (l *Listener) SetProxyProtocol(conf *ProxyProtocolConfig) {
+	l.proxyProtocol = conf
+}
+
 // Accept new connections, return an exnet.Conn
 // if SetAcceptCallback called, accpet callback will call on new
-// connection, if callback return error, accpet return error.
+// connection, if callback return error, the connection is closed and Accept
+// goes on to the next one, so servers like http.Serve are not stopped by a
+// rejected client. Rejections are traced by RejectTracer and sent to the
+// channel of SetRejectChan. Connections failed in PROXY header parsing or
+// TLS handshake are closed and skipped, so are connections rejected by
+// accept policy or limits. Accepted connections are tracked until closed,
+// see ActiveConns and Shutdown.
 func (l *Listener) Accept() (net.Conn, error) {
-	rwc, err := l._l.Accept()
-	if err != nil {
-		return nil, err
-	}
-	c := &Conn{_conn: rwc}
-	if l._acceptCallback != nil {
-		err = l._acceptCallback(c)
+	l.prepareOnce.Do(func() {
+		l.tls = l.loadTLSConfig() != nil
+		if l.tls || l.proxyProtocol != nil {
+			l.preparedc = make(chan preparedConn)
+			l.acceptDone = make(chan struct{})
+			go l.acceptLoop()
+		}
+	})
+	var c *Conn
+	for c == nil {
+		var reserved bool
+		var err error
+		if l.preparedc != nil {
+			c, reserved, err = l.nextPrepared()
+		} else {
+			c, reserved, err = l.next()
+		}
 		if err != nil {
-			c.Close()
+			if atomic.LoadInt32(&l.shutdown) != 0 {
+				return nil, ErrListenerShutdown
+			}
+			return nil, err
+		}
+		if c == nil {
+			continue
+		}
+		if l.replay {
+			c._conn = &replayConn{Conn: c._conn}
+		}
+		switch err = l.track(c, reserved); err {
+		case nil:
+		case ErrListenerShutdown:
+			_ = c._conn.Close()
 			return nil, err
+		default:
+			l.reject(c, err)
+			c = nil
+			continue
+		}
+		if l._acceptCallback != nil {
+			if err = l._acceptCallback(c); err != nil {
+				atomic.AddInt64(&l.metricRejectedCallback, 1)
+				l.reject(c, err)
+				c = nil
+			}
 		}
 	}
+	atomic.AddInt64(&l.metricAccepted, 1)
 	return c, nil
 }
 
-// Close underlying listener
-func (l *Listener) Close() error { return l._l.Close() }
+// SetRejectChan send an *AcceptError to ch for every connection rejected by
+// accept callback, accept policy or limits. The send doesn't block, errors
+// are dropped if ch is full.
+func (l *Listener) SetRejectChan(ch chan<- error) {
+	l.rejectch = ch
+}
+
+// Close underlying listener, and connections not accepted yet
+func (l *Listener) Close() error {
+	l.connsMtx.Lock()
+	atomic.StoreInt32(&l.closed, 1)
+	l.slotCond().Broadcast()
+	l.closePreparing()
+	l.connsMtx.Unlock()
+	return l._l.Close()
+}
 
 // Addr return underlying addr
 func (l *Listener) Addr() net.Addr { return l._l.Addr() }
+
+// next accept a connection and prepare it, return nil if it's skipped
+func (l *Listener) next() (*Conn, bool, error) {
+	reserved := l.waitSlot()
+	rwc, err := l._l.Accept()
+	if err != nil {
+		l.releaseSlot(reserved)
+		return nil, false, err
+	}
+	c := l.prepare(rwc)
+	if c == nil {
+		l.releaseSlot(reserved)
+	}
+	return c, reserved, nil
+}
+
+// nextPrepared return a connection prepared by acceptLoop, or its error
+func (l *Listener) nextPrepared() (*Conn, bool, error) {
+	select {
+	case p := <-l.preparedc:
+		return p.c, p.reserved, p.err
+	case <-l.acceptDone:
+		return nil, false, l.acceptErr
+	}
+}
+
+// acceptLoop accept connections and prepare every one of them in its own
+// goroutine, until the underlying listener fails. Temporary errors are
+// sent to Accept as they are.
+func (l *Listener) acceptLoop() {
+	for {
+		reserved := l.waitSlot()
+		rwc, err := l._l.Accept()
+		if err != nil {
+			l.releaseSlot(reserved)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.preparedc <- preparedConn{err: err}
+				continue
+			}
+			l.acceptErr = err
+			close(l.acceptDone)
+			return
+		}
+		if !l.startPrepare(rwc) {
+			_ = rwc.Close()
+			l.releaseSlot(reserved)
+			continue
+		}
+		go func() {
+			c := l.prepare(rwc)
+			l.finishPrepare(rwc)
+			if c == nil {
+				l.releaseSlot(reserved)
+				return
+			}
+			select {
+			case l.preparedc <- preparedConn{c: c, reserved: reserved}:
+			case <-l.acceptDone:
+				_ = c._conn.Close()
+				l.releaseSlot(reserved)
+			}
+		}()
+	}
+}
+
+// startPrepare add rwc to connections being prepared, return false if the
+// listener is closed or shutting down.
+func (l *Listener) startPrepare(rwc net.Conn) bool {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+	if atomic.LoadInt32(&l.closed) != 0 || atomic.LoadInt32(&l.shutdown) != 0 {
+		return false
+	}
+	if l.preparing == nil {
+		l.preparing = make(map[net.Conn]struct{})
+	}
+	l.preparing[rwc] = struct{}{}
+	return true
+}
+
+func (l *Listener) finishPrepare(rwc net.Conn) {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+	delete(l.preparing, rwc)
+}
+
+// closePreparing close connections being prepared, the caller must hold
+// connsMtx.
+func (l *Listener) closePreparing() {
+	for rwc := range l.preparing {
+		_ = rwc.Close()
+	}
+}
+
+// prepare read PROXY header, check accept policy and do TLS handshake on rwc
+// if they are enabled, return nil if any of them failed.
+func (l *Listener) prepare(rwc net.Conn) *Conn {
+	if o := l.tcpOptions; o != nil {
+		if tc, ok := rwc.(*net.TCPConn); ok {
+			if err := o.setsockopt(tc); err != nil {
+				l.reject(&Conn{_conn: rwc}, err)
+				return nil
+			}
+		}
+	}
+	var header *ProxyHeader
+	if conf := l.proxyProtocol; conf != nil && conf.trusted(rwc.RemoteAddr()) {
+		pc, err := conf.readProxyHeader(rwc)
+		if tracer, ok := l.loadTracer().(ProxyHeaderTracer); ok && (err != nil || pc.header != nil) {
+			c := &Conn{_conn: rwc}
+			if pc != nil {
+				c._conn = pc
+				tracer.TraceProxyHeader(c, pc.header, nil)
+			} else {
+				tracer.TraceProxyHeader(c, nil, err)
+			}
+		}
+		if err != nil {
+			_ = rwc.Close()
+			return nil
+		}
+		rwc, header = pc, pc.header
+	}
+	c := &Conn{_conn: rwc, proxyHeader: header}
+	if err := l.allow(c); err != nil {
+		l.reject(c, err)
+		return nil
+	}
+	if l.tls {
+		if c = l.handshake(rwc); c == nil {
+			return nil
+		}
+		c.proxyHeader = header
+	}
+	c.timeouts = newConnTimeouts(l.loadTimeouts())
+	return c
+}
+
+// handshake terminate TLS on rwc, return nil if the handshake failed.
+func (l *Listener) handshake(rwc net.Conn) *Conn {
+	timeout := time.Duration(atomic.LoadInt64(&l.handshakeTimeout))
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	conf := l.loadTLSConfig()
+	if conf == nil {
+		// TLS was removed after the first Accept
+		conf = &tls.Config{}
+	}
+	tlsConn := tls.Server(rwc, conf)
+	err := tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+	if err == nil {
+		err = tlsConn.SetDeadline(time.Time{})
+	}
+	c := &Conn{_conn: tlsConn}
+	if tracer, ok := l.loadTracer().(HandshakeTracer); ok {
+		state := tlsConn.ConnectionState()
+		tracer.TraceHandshake(c, &state, err)
+	}
+	if err != nil {
+		_ = rwc.Close()
+		return nil
+	}
+	return c
+}
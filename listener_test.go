@@ -0,0 +1,528 @@
+package exnet_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+)
+
+func writeCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NoError(t, err)
+	// write to temp files then rename, so the reloader never sees a half
+	// written pair
+	assert.NoError(t, ioutil.WriteFile(certFile+".tmp",
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644))
+	assert.NoError(t, ioutil.WriteFile(keyFile+".tmp",
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+	assert.NoError(t, os.Rename(keyFile+".tmp", keyFile))
+	assert.NoError(t, os.Rename(certFile+".tmp", certFile))
+}
+
+func TestListenTLS(t *testing.T) {
+	serverCert, serverPool := testCertificate(t, "server")
+	clientCert, clientPool := testCertificate(t, "client")
+
+	var mtx sync.Mutex
+	var handshakes []error
+	lis, err := exnet.ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	})
+	assert.NoError(t, err)
+	defer lis.Close()
+	lis.SetTLSHandshakeTimeout(time.Second)
+	lis.SetTracer(exnet.TraceHandshake(func(conn net.Conn, state *tls.ConnectionState, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		handshakes = append(handshakes, err)
+	}))
+	peers := make(chan string, 1)
+	lis.SetAcceptCallback(func(conn net.Conn) error {
+		peers <- exnet.PeerIdentity(conn)
+		return nil
+	})
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, len(cmsg))
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					_, _ = conn.Write(smsg)
+				}
+			}()
+		}
+	}()
+
+	// client without certificate is rejected in handshake, the listener
+	// keeps accepting
+	conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: serverPool})
+	if err == nil {
+		_, err = conn.Write(cmsg)
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		conn.Close()
+	}
+	assert.Error(t, err)
+
+	conn, err = tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+		RootCAs:      serverPool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write(cmsg)
+	assert.NoError(t, err)
+	buf := make([]byte, len(smsg))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, smsg, buf)
+	assert.Equal(t, "CN=client", <-peers)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if assert.Len(t, handshakes, 2) {
+		assert.Error(t, handshakes[0])
+		assert.NoError(t, handshakes[1])
+	}
+}
+
+func TestListenTLSSlowClient(t *testing.T) {
+	serverCert, serverPool := testCertificate(t, "server")
+	lis, err := exnet.ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	})
+	assert.NoError(t, err)
+	lis.SetTLSHandshakeTimeout(5 * time.Second)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// a client which never sends its hello doesn't hold up others
+	slow, err := net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	defer slow.Close()
+	conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: serverPool})
+	if assert.NoError(t, err) {
+		defer conn.Close()
+	}
+	select {
+	case c := <-accepted:
+		_, ok := exnet.TLSConnectionState(c)
+		assert.True(t, ok)
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("handshake is blocked by a slow client")
+	}
+
+	// the slow client is closed with the listener
+	assert.NoError(t, lis.Close())
+	_, ok := <-accepted
+	assert.False(t, ok)
+	_ = slow.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = slow.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenTLSSetWhileAccepting(t *testing.T) {
+	serverCert, serverPool := testCertificate(t, "server")
+	conf := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	lis, err := exnet.ListenTLS("tcp", "127.0.0.1:0", conf)
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(smsg)
+			_ = conn.Close()
+		}
+	}()
+
+	// run with -race, settings are read by handshakes in background
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			lis.SetTracer(exnet.TraceHandshake(func(net.Conn, *tls.ConnectionState, error) {}))
+			lis.SetTLSConfig(conf.Clone())
+			lis.SetTLSHandshakeTimeout(time.Duration(i+1) * time.Second)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: serverPool})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		buf := make([]byte, len(smsg))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		conn.Close()
+	}
+	<-done
+
+	// TLS can't be disabled after the first Accept, handshakes fail
+	lis.SetTLSConfig(nil)
+	conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: serverPool})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet-cert")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	oldCert, oldPool := testCertificate(t, "old")
+	writeCertificate(t, oldCert, certFile, keyFile)
+	reloader, err := exnet.NewCertReloader(certFile, keyFile, 10*time.Millisecond, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	reloader.Watch()
+	defer reloader.Close()
+
+	lis, err := exnet.ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	})
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	echo := func(conn net.Conn) {
+		_, err := conn.Write(cmsg)
+		assert.NoError(t, err)
+		buf := make([]byte, len(cmsg))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+	}
+	oldConn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: oldPool})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer oldConn.Close()
+	echo(oldConn)
+
+	newCert, newPool := testCertificate(t, "new")
+	writeCertificate(t, newCert, certFile, keyFile)
+	assert.Eventually(t, func() bool {
+		return bytes.Equal(reloader.Certificate().Certificate[0], newCert.Certificate[0])
+	}, time.Second, 10*time.Millisecond)
+
+	// new connections see the new certificate, the old one still works
+	newConn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: newPool})
+	if assert.NoError(t, err) {
+		echo(newConn)
+		newConn.Close()
+	}
+	echo(oldConn)
+
+	// a broken file keeps the last good certificate
+	assert.NoError(t, ioutil.WriteFile(certFile, []byte("broken"), 0644))
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, newCert.Certificate[0], reloader.Certificate().Certificate[0])
+}
+
+func TestListenerShutdown(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	signaled := make(chan net.Conn, 2)
+	lis.SetShutdownSignal(func(conn net.Conn) { signaled <- conn })
+	acceptErr := make(chan error, 1)
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	first, second := <-accepted, <-accepted
+	assert.Len(t, lis.ActiveConns(), 2)
+	assert.NoError(t, first.Close())
+	assert.Equal(t, []net.Conn{second}, lis.ActiveConns())
+
+	// the remaining connection is closed on signal
+	go func() { _ = (<-signaled).Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, lis.Shutdown(ctx))
+	assert.Equal(t, exnet.ErrListenerShutdown, <-acceptErr)
+	assert.Len(t, lis.ActiveConns(), 0)
+	_, err = clients[1].Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenerShutdownTimeout(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	conn, err := lis.Accept()
+	assert.NoError(t, err)
+
+	// a busy connection is closed by force after ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, lis.Shutdown(ctx))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Len(t, lis.ActiveConns(), 0)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestListenerConnLimit(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	lis.SetConnLimit(&exnet.ConnLimitConfig{MaxConns: 1})
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	first, err := lis.Accept()
+	assert.NoError(t, err)
+
+	// Accept blocks until the first one is closed
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lis.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted over MaxConns")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, first.Close())
+	second := <-accepted
+	assert.Equal(t, clients[1].LocalAddr().String(), second.RemoteAddr().String())
+	defer second.Close()
+
+	// a blocked Accept returns when the listener is closed
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, lis.Close())
+	}()
+	_, err = lis.Accept()
+	assert.Error(t, err)
+}
+
+// skipWithoutLoopback skip the test if a client can't bind ips, e.g. only
+// 127.0.0.1 is configured on loopback of macOS
+func skipWithoutLoopback(t *testing.T, ips ...string) {
+	for _, ip := range ips {
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			t.Skipf("%s is not available: %v", ip, err)
+		}
+		l.Close()
+	}
+}
+
+func TestListenerConnLimitReject(t *testing.T) {
+	skipWithoutLoopback(t, "127.0.0.2", "127.0.0.3")
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	lis.SetConnLimit(&exnet.ConnLimitConfig{MaxConns: 2, MaxConnsPerIP: 1, Reject: true})
+	rejected := make(chan error, 10)
+	lis.SetTracer(exnet.TraceReject(func(conn net.Conn, err error) { rejected <- err }))
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func(local string) net.Conn {
+		d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+		conn, err := d.Dial("tcp", lis.Addr().String())
+		assert.NoError(t, err)
+		return conn
+	}
+	expectClosed := func(conn net.Conn) {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		conn.Close()
+	}
+
+	a1 := dial("127.0.0.1")
+	defer a1.Close()
+	first := <-accepted
+	expectClosed(dial("127.0.0.1"))
+	assert.Equal(t, exnet.ErrTooManyConnsPerIP, <-rejected)
+
+	b1 := dial("127.0.0.2")
+	defer b1.Close()
+	<-accepted
+	expectClosed(dial("127.0.0.3"))
+	assert.Equal(t, exnet.ErrTooManyConns, <-rejected)
+
+	// slots are freed on close
+	assert.NoError(t, first.Close())
+	a2 := dial("127.0.0.1")
+	defer a2.Close()
+	<-accepted
+	assert.Equal(t, map[string]int64{
+		"accepted":           3,
+		"active":             2,
+		"rejected_max_conns": 1,
+		"rejected_per_ip":    1,
+		"rejected_policy":    0,
+		"rejected_callback":  0,
+	}, lis.Metrics())
+}
+
+func TestListenerAcceptCallbackReject(t *testing.T) {
+	skipWithoutLoopback(t, "127.0.0.2")
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	errDenied := errors.New("denied")
+	lis.SetAcceptCallback(func(conn net.Conn) error {
+		if conn.RemoteAddr().(*net.TCPAddr).IP.Equal(net.ParseIP("127.0.0.2")) {
+			return errDenied
+		}
+		return nil
+	})
+	rejected := make(chan error, 10)
+	lis.SetRejectChan(rejected)
+	go func() {
+		_ = http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "hello")
+		}))
+	}()
+
+	get := func(local string) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}).DialContext,
+		}}
+		return client.Get("http://" + lis.Addr().String())
+	}
+	// rejected clients don't stop the server
+	for i := 0; i < 3; i++ {
+		_, err = get("127.0.0.2")
+		assert.Error(t, err)
+		err := <-rejected
+		assert.True(t, errors.Is(err, errDenied))
+		ne, ok := err.(net.Error)
+		assert.True(t, ok && ne.Temporary())
+
+		resp, err := get("127.0.0.1")
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+	}
+	assert.Equal(t, int64(3), lis.Metrics()["rejected_callback"])
+	assert.Equal(t, int64(3), lis.Metrics()["accepted"])
+}
+
+func TestListenerAcceptLoop(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	n := 0
+	lis.SetAcceptCallback(func(conn net.Conn) error {
+		if n++; n%2 == 1 {
+			return errors.New("odd")
+		}
+		return nil
+	})
+	traced := make(chan error, 10)
+	lis.SetTracer(exnet.TraceReject(func(conn net.Conn, err error) { traced <- err }))
+
+	var clients []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	// Accept only returns the allowed ones
+	for i := 1; i < 4; i += 2 {
+		conn, err := lis.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, clients[i].LocalAddr().String(), conn.RemoteAddr().String())
+		assert.EqualError(t, <-traced, "odd")
+		conn.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package exnet
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ClusterManager holds named clusters and dial them by name, it makes one
+// dial function serve many services, e.g. as DialContext of http.Transport
+// or the dial function of mysql.RegisterDial.
+type ClusterManager struct {
+	clusters map[string]*Cluster
+	mtx      sync.RWMutex
+	fallback *Dialer
+}
+
+// NewClusterManager create a ClusterManager, addresses which are not a
+// registered cluster name are dialed by fallback, if fallback is nil, a
+// default Dialer is used.
+func NewClusterManager(fallback *Dialer) *ClusterManager {
+	if fallback == nil {
+		fallback = &Dialer{dialer: &net.Dialer{}}
+	}
+	return &ClusterManager{
+		clusters: make(map[string]*Cluster),
+		fallback: fallback,
+	}
+}
+
+// Register a cluster with name, replace the old one if name exists.
+func (m *ClusterManager) Register(name string, c *Cluster) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.clusters[name] = c
+}
+
+// Unregister the cluster with name, return the removed cluster or nil
+func (m *ClusterManager) Unregister(name string) *Cluster {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	c := m.clusters[name]
+	delete(m.clusters, name)
+	return c
+}
+
+// Cluster return the cluster with name
+func (m *ClusterManager) Cluster(name string) (*Cluster, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	c, ok := m.clusters[name]
+	return c, ok
+}
+
+// Dial create an empty context and dial with it
+func (m *ClusterManager) Dial(network, address string) (net.Conn, error) {
+	return m.DialContext(context.Background(), network, address)
+}
+
+// DialContext dial the cluster named address, or the host part of address
+// like "echo:80" which is what http.Transport passes. Address which is not
+// a cluster name is dialed directly by the fallback Dialer.
+func (m *ClusterManager) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if c := m.lookup(address); c != nil {
+		return c.DialContext(ctx, network, address)
+	}
+	return m.fallback.DialContext(ctx, network, address)
+}
+
+func (m *ClusterManager) lookup(address string) *Cluster {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if c, ok := m.clusters[address]; ok {
+		return c
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return m.clusters[host]
+	}
+	return nil
+}
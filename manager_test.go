@@ -0,0 +1,137 @@
+package exnet_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func TestClusterManager(t *testing.T) {
+	srvs := makeServers(t, 2)
+	defer func() {
+		for _, s := range srvs {
+			s.stop()
+		}
+	}()
+	manager := exnet.NewClusterManager(nil)
+	for i, name := range []string{"echo", "echo2"} {
+		cluster := exnet.NewCluster(&exnet.ClusterConfig{
+			DialTimeout:  time.Second,
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+		})
+		ap := addresspicker.NewRoundRobin(nil)
+		assert.NoError(t, ap.AppendTCPAddress("tcp", srvs[i].listener.Addr().String()))
+		cluster.AddressPicker = ap
+		manager.Register(name, cluster)
+	}
+	c, ok := manager.Cluster("echo")
+	assert.True(t, ok)
+	assert.NotNil(t, c)
+
+	for i, address := range []string{"echo", "echo2:80", srvs[0].listener.Addr().String()} {
+		conn, err := manager.Dial("tcp", address)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		remote := srvs[0].listener.Addr().(*net.TCPAddr).Port
+		if i == 1 {
+			remote = srvs[1].listener.Addr().(*net.TCPAddr).Port
+		}
+		assert.Equal(t, remote, conn.RemoteAddr().(*net.TCPAddr).Port)
+		_, err = conn.Write(cmsg)
+		assert.NoError(t, err)
+		buf := make([]byte, len(smsg))
+		_, err = conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, smsg, buf)
+		assert.NoError(t, conn.Close())
+	}
+
+	assert.NotNil(t, manager.Unregister("echo2"))
+	_, ok = manager.Cluster("echo2")
+	assert.False(t, ok)
+	// unknown name falls back to plain dialing
+	_, err := manager.Dial("tcp", "echo2:80")
+	assert.Error(t, err)
+}
+
+func TestClusterManagerParallelFallback(t *testing.T) {
+	srvs := makeServers(t, 1)
+	defer srvs[0].stop()
+	address := srvs[0].listener.Addr().String()
+
+	// run with -race, the default fallback and a zero Dialer are shared
+	for _, manager := range []*exnet.ClusterManager{
+		exnet.NewClusterManager(nil),
+		exnet.NewClusterManager(&exnet.Dialer{}),
+	} {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := manager.Dial("tcp", address)
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = conn.Write(cmsg)
+				assert.NoError(t, err)
+				buf := make([]byte, len(smsg))
+				_, err = conn.Read(buf)
+				assert.NoError(t, err)
+				assert.NoError(t, conn.Close())
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestClusterManagerHTTPTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", srv.Listener.Addr().String()))
+	cluster.AddressPicker = ap
+	manager := exnet.NewClusterManager(nil)
+	manager.Register("backend", cluster)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return manager.DialContext(ctx, network, addr)
+		},
+	}}
+	for url, host := range map[string]string{
+		"http://backend/": "backend",
+		srv.URL:           strings.TrimPrefix(srv.URL, "http://"),
+	} {
+		resp, err := client.Get(url)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, resp.Body.Close())
+		assert.Equal(t, host, string(b))
+	}
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_direct"])
+}
@@ -0,0 +1,328 @@
+package exnet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSniffTimeout = 5 * time.Second
+	// max bytes peeked by matchers
+	muxMaxPeek = 4096
+	// backoff of Serve on temporary Accept errors
+	muxAcceptDelayMin = 5 * time.Millisecond
+	muxAcceptDelayMax = time.Second
+)
+
+var httpMethods = []string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH ",
+}
+
+// Matcher tells whether a connection is of a protocol by the first bytes
+// read from r, they are replayed to the handler of the connection whatever
+// is read. Reading more than 4096 bytes returns io.EOF. A custom predicate
+// is a Matcher reading as many bytes as it needs.
+type Matcher func(r io.Reader) bool
+
+// MuxConfig config for Mux
+type MuxConfig struct {
+	// SniffTimeout is the max duration to read the bytes matched, default
+	// is 5 seconds.
+	SniffTimeout time.Duration
+}
+
+// Mux serves several protocols on one Listener, it peeks the first bytes of
+// every accepted connection, and dispatches the connection to the first
+// child listener whose matchers match. Connections matched nothing or
+// timed out are rejected, see Listener.SetRejectChan.
+type Mux struct {
+	l       *Listener
+	timeout time.Duration
+
+	mtx      sync.Mutex
+	children []*muxListener
+	err      error
+}
+
+type muxListener struct {
+	mux      *Mux
+	matchers []Matcher
+	connch   chan net.Conn
+	donech   chan struct{}
+	once     sync.Once
+}
+
+// NewMux create a Mux on l, call Serve to start dispatching. l must not be
+// accepted by others.
+func NewMux(l *Listener, conf *MuxConfig) *Mux {
+	if conf == nil {
+		panic("MuxConfig can't be nil")
+	}
+	// bytes sniffed are replayed by a wrapper set before the connections
+	// are tracked, so it's never changed when they're visible to Shutdown
+	l.replay = true
+	m := &Mux{l: l, timeout: conf.SniffTimeout}
+	if m.timeout <= 0 {
+		m.timeout = defaultSniffTimeout
+	}
+	return m
+}
+
+// Match return a child listener of connections matched by any of matchers,
+// child listeners are matched in order they are created. Connections from
+// it are the exnet.Conn accepted by the Listener of mux.
+func (m *Mux) Match(matchers ...Matcher) net.Listener {
+	child := &muxListener{
+		mux:      m,
+		matchers: matchers,
+		connch:   make(chan net.Conn),
+		donech:   make(chan struct{}),
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.children = append(m.children, child)
+	return child
+}
+
+// Serve accept connections and dispatch them until the Listener fails, the
+// error is returned, and by Accept of child listeners. Temporary errors,
+// e.g. too many open files, are retried with backoff.
+func (m *Mux) Serve() error {
+	var delay time.Duration
+	for {
+		conn, err := m.l.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if delay *= 2; delay == 0 {
+				delay = muxAcceptDelayMin
+			} else if delay > muxAcceptDelayMax {
+				delay = muxAcceptDelayMax
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if err != nil {
+			m.mtx.Lock()
+			m.err = err
+			children := m.children
+			m.mtx.Unlock()
+			for _, child := range children {
+				_ = child.Close()
+			}
+			return err
+		}
+		go m.dispatch(conn.(*Conn))
+	}
+}
+
+// Close the Listener of mux
+func (m *Mux) Close() error {
+	return m.l.Close()
+}
+
+func (m *Mux) dispatch(c *Conn) {
+	buf, err := m.sniff(c)
+	if err == nil {
+		err = ErrNoProtocolMatch
+		m.mtx.Lock()
+		children := m.children
+		m.mtx.Unlock()
+		for _, child := range children {
+			if child.match(c, buf) {
+				// the conn is read by nobody else until it's put
+				c._conn.(*replayConn).rest = buf.buf
+				if child.put(c) {
+					return
+				}
+				err = ErrListenerShutdown
+				break
+			}
+		}
+		if err == ErrNoProtocolMatch && buf.err != nil {
+			// timed out or closed while sniffing
+			err = buf.err
+		}
+	}
+	m.l.reject(c, err)
+}
+
+// sniff prepare a buffer for matchers
+func (m *Mux) sniff(c *Conn) (*sniffBuffer, error) {
+	if err := c._conn.SetReadDeadline(time.Now().Add(m.timeout)); err != nil {
+		return nil, err
+	}
+	return &sniffBuffer{conn: c._conn}, nil
+}
+
+// match run matchers on the buffer, and restore read deadline of c
+func (child *muxListener) match(c *Conn, buf *sniffBuffer) bool {
+	matched := false
+	for _, matcher := range child.matchers {
+		if matcher(&sniffReader{buf: buf}) {
+			matched = true
+			break
+		}
+	}
+	if matched {
+		// deadline set by user in accept callback, if any, is lost
+		var d time.Time
+		if c.timeouts != nil {
+			d = c.timeouts.userRead
+		}
+		_ = c._conn.SetReadDeadline(d)
+	}
+	return matched
+}
+
+func (child *muxListener) put(c *Conn) bool {
+	select {
+	case child.connch <- c:
+		return true
+	case <-child.donech:
+		return false
+	}
+}
+
+func (child *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-child.connch:
+		return c, nil
+	case <-child.donech:
+		child.mux.mtx.Lock()
+		defer child.mux.mtx.Unlock()
+		if child.mux.err != nil {
+			return nil, child.mux.err
+		}
+		return nil, ErrListenerShutdown
+	}
+}
+
+// Close stop the child listener, connections matched by it are rejected
+func (child *muxListener) Close() error {
+	child.once.Do(func() { close(child.donech) })
+	return nil
+}
+
+func (child *muxListener) Addr() net.Addr {
+	return child.mux.l.Addr()
+}
+
+// sniffBuffer keeps bytes read by matchers
+type sniffBuffer struct {
+	conn net.Conn
+	buf  []byte
+	err  error
+}
+
+// sniffReader replays a sniffBuffer and reads more into it
+type sniffReader struct {
+	buf *sniffBuffer
+	off int
+}
+
+func (r *sniffReader) Read(b []byte) (int, error) {
+	s := r.buf
+	if r.off < len(s.buf) {
+		n := copy(b, s.buf[r.off:])
+		r.off += n
+		return n, nil
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if len(s.buf) >= muxMaxPeek {
+		return 0, io.EOF
+	}
+	if len(b) > muxMaxPeek-len(s.buf) {
+		b = b[:muxMaxPeek-len(s.buf)]
+	}
+	n, err := s.conn.Read(b)
+	s.buf = append(s.buf, b[:n]...)
+	s.err = err
+	r.off += n
+	return n, err
+}
+
+// replayConn replays rest before reading the connection, it's not a
+// connWrapper, so UnwrapConn keeps the bytes sniffed by Mux. See socketConn
+// for the connection replayed.
+type replayConn struct {
+	net.Conn
+	rest []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.rest) > 0 {
+		n := copy(b, c.rest)
+		c.rest = c.rest[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// MatchAny matches any connection
+func MatchAny() Matcher {
+	return func(io.Reader) bool { return true }
+}
+
+// MatchPrefix matches connections start with any of prefixes
+func MatchPrefix(prefixes ...string) Matcher {
+	max := 0
+	for _, p := range prefixes {
+		if len(p) > max {
+			max = len(p)
+		}
+	}
+	return func(r io.Reader) bool {
+		// read byte by byte, so a short prefix matches without waiting for
+		// more bytes
+		var buf []byte
+		b := make([]byte, 1)
+		for len(buf) < max {
+			if _, err := io.ReadFull(r, b); err != nil {
+				return false
+			}
+			buf = append(buf, b[0])
+			candidate := false
+			for _, p := range prefixes {
+				if len(buf) >= len(p) && string(buf[:len(p)]) == p {
+					return true
+				}
+				if len(buf) < len(p) && bytes.HasPrefix([]byte(p), buf) {
+					candidate = true
+				}
+			}
+			if !candidate {
+				return false
+			}
+		}
+		return false
+	}
+}
+
+// MatchHTTP1 matches HTTP/1.x requests by method
+func MatchHTTP1() Matcher {
+	return MatchPrefix(httpMethods...)
+}
+
+// MatchHTTP2 matches HTTP/2 connections with prior knowledge, e.g. h2c or
+// gRPC without TLS.
+func MatchHTTP2() Matcher {
+	return MatchPrefix("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+}
+
+// MatchTLS matches TLS connections by the record header of ClientHello
+func MatchTLS() Matcher {
+	return func(r io.Reader) bool {
+		// content type handshake, major version 3, 2 bytes length, and
+		// handshake type client hello
+		b := make([]byte, 6)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return false
+		}
+		return b[0] == 0x16 && b[1] == 0x03 && b[5] == 0x01
+	}
+}
@@ -0,0 +1,190 @@
+package exnet_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+)
+
+func TestMux(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	var read int64
+	lis.SetAcceptCallback(func(conn net.Conn) error {
+		return exnet.TraceConn(conn, exnet.TraceRead(func(conn net.Conn, data []byte, err error) {
+			atomic.AddInt64(&read, 1)
+		}))
+	})
+	rejected := make(chan error, 1)
+	lis.SetRejectChan(rejected)
+
+	mux := exnet.NewMux(lis, &exnet.MuxConfig{SniffTimeout: 200 * time.Millisecond})
+	httpL := mux.Match(exnet.MatchHTTP1())
+	tlsL := mux.Match(exnet.MatchTLS())
+	rpcL := mux.Match(exnet.MatchPrefix("RPC1", "RPC2"))
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- mux.Serve() }()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isExnet := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		fmt.Fprintf(w, "%s %v", r.Proto, isExnet)
+	})
+	go func() { _ = http.Serve(httpL, handler) }()
+	cert, pool := testCertificate(t, "server")
+	go func() {
+		_ = http.Serve(tls.NewListener(tlsL, &tls.Config{Certificates: []tls.Certificate{cert}}), handler)
+	}()
+	go func() {
+		for {
+			conn, err := rpcL.Accept()
+			if err != nil {
+				return
+			}
+			_, ok := conn.(*exnet.Conn)
+			assert.True(t, ok)
+			// the peeked bytes are kept by UnwrapConn
+			buf := make([]byte, 8)
+			n, _ := io.ReadFull(exnet.UnwrapConn(conn), buf[:4])
+			m, _ := io.ReadFull(conn, buf[4:])
+			_, _ = conn.Write(buf[:n+m])
+			conn.Close()
+		}
+	}()
+
+	addr := lis.Addr().String()
+	resp, err := http.Get("http://" + addr)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/1.1 true", string(body))
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"}}}
+	resp, err = client.Get("https://" + addr)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/1.1 true", string(body))
+	}
+
+	// peeked bytes are replayed, and traced
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("RPC2ping"))
+	assert.NoError(t, err)
+	echo, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "RPC2ping", string(echo))
+	conn.Close()
+	assert.True(t, atomic.LoadInt64(&read) > 0)
+
+	// unknown protocol
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("SSH-2.0"))
+	assert.NoError(t, err)
+	assert.Equal(t, exnet.ErrNoProtocolMatch, (<-rejected).(*exnet.AcceptError).Err)
+	conn.Close()
+
+	// silent client times out
+	conn, err = net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	start := time.Now()
+	err = (<-rejected).(*exnet.AcceptError).Err
+	ne, ok := err.(net.Error)
+	assert.True(t, ok && ne.Timeout(), "%v", err)
+	assert.InDelta(t, 200*time.Millisecond, time.Since(start), float64(100*time.Millisecond))
+	conn.Close()
+
+	// children fail when the listener is closed
+	assert.NoError(t, mux.Close())
+	assert.Error(t, <-serveErr)
+	_, err = rpcL.Accept()
+	assert.Error(t, err)
+}
+
+// tempErrListener fails Accept with a temporary error n times
+type tempErrListener struct {
+	net.Listener
+	n int32
+}
+
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+func (l *tempErrListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.n, -1) >= 0 {
+		return nil, tempErr{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestMuxServeTemporaryError(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	mux := exnet.NewMux(exnet.WithListener(&tempErrListener{Listener: raw, n: 3}), &exnet.MuxConfig{})
+	anyL := mux.Match(exnet.MatchAny())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- mux.Serve() }()
+
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(cmsg)
+	assert.NoError(t, err)
+	sconn, err := anyL.Accept()
+	if assert.NoError(t, err) {
+		buf := make([]byte, len(cmsg))
+		_, err = io.ReadFull(sconn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, cmsg, buf)
+		sconn.Close()
+	}
+
+	assert.NoError(t, mux.Close())
+	assert.Error(t, <-serveErr)
+	_, err = anyL.Accept()
+	assert.Error(t, err)
+}
+
+func TestMatchPrefix(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	mux := exnet.NewMux(lis, &exnet.MuxConfig{})
+	short := mux.Match(exnet.MatchPrefix("A"))
+	any := mux.Match(exnet.MatchAny())
+	go func() { _ = mux.Serve() }()
+	defer mux.Close()
+
+	for _, c := range []struct {
+		data string
+		l    net.Listener
+	}{{"A", short}, {"BA", any}} {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		assert.NoError(t, err)
+		// a short prefix matches without waiting for more bytes
+		_, _ = conn.Write([]byte(c.data))
+		server, err := c.l.Accept()
+		if assert.NoError(t, err) {
+			buf := make([]byte, 4)
+			n, err := server.Read(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, c.data[:1], string(buf[:n][:1]))
+			server.Close()
+		}
+		conn.Close()
+	}
+}
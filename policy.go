@@ -0,0 +1,271 @@
+package exnet
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRateLimitSources = 10000
+
+// AcceptPolicy decides whether a connection accepted by Listener is allowed,
+// it returns an error to reject the connection.
+type AcceptPolicy interface {
+	Allow(conn net.Conn) error
+}
+
+// AcceptPolicyFunc is function implement AcceptPolicy interface
+type AcceptPolicyFunc func(conn net.Conn) error
+
+// Allow implement AcceptPolicy interface
+func (f AcceptPolicyFunc) Allow(conn net.Conn) error {
+	return f(conn)
+}
+
+// AcceptPolicies compose policies, a connection is allowed if all of them
+// allow it, they are checked in order.
+func AcceptPolicies(policies ...AcceptPolicy) AcceptPolicy {
+	return AcceptPolicyFunc(func(conn net.Conn) error {
+		for _, p := range policies {
+			if err := p.Allow(conn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetAcceptPolicy check every accepted connection with p, after PROXY header
+// is read and before TLS handshake, so the policy sees the real client
+// address. Rejected connections are closed, traced by RejectTracer and
+// counted in Metrics. It's safe to call while accepting, nil removes the
+// policy.
+func (l *Listener) SetAcceptPolicy(p AcceptPolicy) {
+	l.policy.Store(&p)
+}
+
+// allow check c with the accept policy
+func (l *Listener) allow(c *Conn) error {
+	p, _ := l.policy.Load().(*AcceptPolicy)
+	if p == nil || *p == nil {
+		return nil
+	}
+	if err := (*p).Allow(c); err != nil {
+		atomic.AddInt64(&l.metricRejectedPolicy, 1)
+		return err
+	}
+	return nil
+}
+
+// CIDRPolicyConfig config for CIDRPolicy
+type CIDRPolicyConfig struct {
+	// Allow is the networks allowed, empty means all are allowed
+	Allow []*net.IPNet
+	// Deny is the networks denied, it takes precedence over Allow
+	Deny []*net.IPNet
+}
+
+// CIDRPolicy is an AcceptPolicy allows or denies connections by source IP,
+// IPv4 and IPv6 networks can be mixed.
+type CIDRPolicy struct {
+	// current *CIDRPolicyConfig
+	conf atomic.Value
+}
+
+// NewCIDRPolicy create a CIDRPolicy
+func NewCIDRPolicy(conf *CIDRPolicyConfig) *CIDRPolicy {
+	if conf == nil {
+		panic("CIDRPolicyConfig can't be nil")
+	}
+	p := &CIDRPolicy{}
+	p.conf.Store(conf)
+	return p
+}
+
+// Update replace the networks, the following connections are checked with
+// the new ones.
+func (p *CIDRPolicy) Update(conf *CIDRPolicyConfig) error {
+	if conf == nil {
+		return ErrNilConfig
+	}
+	p.conf.Store(conf)
+	return nil
+}
+
+// Allow implement AcceptPolicy interface, return ErrDenied if the source IP
+// of conn is denied. Connections not over IP, e.g. unix sockets, are allowed.
+func (p *CIDRPolicy) Allow(conn net.Conn) error {
+	ip := addrIP(conn.RemoteAddr())
+	if ip == nil {
+		return nil
+	}
+	conf := p.conf.Load().(*CIDRPolicyConfig)
+	if containsIP(conf.Deny, ip) {
+		return ErrDenied
+	}
+	if len(conf.Allow) > 0 && !containsIP(conf.Allow, ip) {
+		return ErrDenied
+	}
+	return nil
+}
+
+// RateLimitConfig config for RateLimitPolicy
+type RateLimitConfig struct {
+	// Rate is the number of connections allowed per second from a source IP
+	Rate float64
+	// Burst is the max number of connections allowed at once from a source
+	// IP, default is 1.
+	Burst int
+	// MaxSources is the max number of source IPs tracked, the least recently
+	// seen ones are forgotten, default is 10000.
+	MaxSources int
+}
+
+// RateLimitPolicy is an AcceptPolicy limits the accept rate of every source
+// IP by token buckets.
+type RateLimitPolicy struct {
+	mtx     sync.Mutex
+	rate    float64
+	burst   int
+	max     int
+	lru     *list.List
+	sources map[string]*list.Element
+}
+
+type rateLimitSource struct {
+	ip     string
+	bucket tokenBucket
+}
+
+// NewRateLimitPolicy create a RateLimitPolicy
+func NewRateLimitPolicy(conf *RateLimitConfig) *RateLimitPolicy {
+	if conf == nil {
+		panic("RateLimitConfig can't be nil")
+	}
+	p := &RateLimitPolicy{
+		lru:     list.New(),
+		sources: make(map[string]*list.Element),
+	}
+	p.setConfig(conf)
+	return p
+}
+
+// Update change the limits, tracked sources keep their tokens
+func (p *RateLimitPolicy) Update(conf *RateLimitConfig) error {
+	if conf == nil {
+		return ErrNilConfig
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.setConfig(conf)
+	p.evict()
+	return nil
+}
+
+func (p *RateLimitPolicy) setConfig(conf *RateLimitConfig) {
+	p.rate, p.burst, p.max = conf.Rate, conf.Burst, conf.MaxSources
+	if p.burst <= 0 {
+		p.burst = 1
+	}
+	if p.max <= 0 {
+		p.max = defaultRateLimitSources
+	}
+}
+
+// Allow implement AcceptPolicy interface, return ErrRateLimited if the source
+// IP of conn has no token. Connections not over IP are allowed.
+func (p *RateLimitPolicy) Allow(conn net.Conn) error {
+	ip := addrIP(conn.RemoteAddr())
+	if ip == nil {
+		return nil
+	}
+	key := ip.String()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+	var src *rateLimitSource
+	if e, ok := p.sources[key]; ok {
+		p.lru.MoveToFront(e)
+		src = e.Value.(*rateLimitSource)
+	} else {
+		src = &rateLimitSource{ip: key, bucket: newTokenBucket(p.burst, now)}
+		p.sources[key] = p.lru.PushFront(src)
+		p.evict()
+	}
+	if !src.bucket.take(now, p.rate, p.burst) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// Sources return the number of source IPs tracked
+func (p *RateLimitPolicy) Sources() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.lru.Len()
+}
+
+// evict forget the least recently seen sources over max
+func (p *RateLimitPolicy) evict() {
+	for p.lru.Len() > p.max {
+		e := p.lru.Back()
+		p.lru.Remove(e)
+		delete(p.sources, e.Value.(*rateLimitSource).ip)
+	}
+}
+
+// tokenBucket is a token bucket refilled at rate tokens per second up to
+// burst tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int, now time.Time) tokenBucket {
+	return tokenBucket{tokens: float64(burst), last: now}
+}
+
+// refill add tokens since last refill
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		b.last = now
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+}
+
+// take a token, return false if there is none
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// addrIP return IP of a tcp or udp address, nil for others
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
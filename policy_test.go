@@ -0,0 +1,131 @@
+package exnet_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+)
+
+type testAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c testAddrConn) RemoteAddr() net.Addr { return c.addr }
+
+func connFrom(ip string) net.Conn {
+	return testAddrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 10000}}
+}
+
+func TestCIDRPolicy(t *testing.T) {
+	allow, err := exnet.ParseCIDRs("10.0.0.0/8", "fd00::/8")
+	assert.NoError(t, err)
+	deny, err := exnet.ParseCIDRs("10.0.0.1", "fd00::1")
+	assert.NoError(t, err)
+	p := exnet.NewCIDRPolicy(&exnet.CIDRPolicyConfig{Allow: allow, Deny: deny})
+
+	for ip, want := range map[string]error{
+		"10.1.2.3":         nil,
+		"::ffff:10.1.2.3":  nil,
+		"fd00::2":          nil,
+		"10.0.0.1":         exnet.ErrDenied,
+		"fd00::1":          exnet.ErrDenied,
+		"192.168.0.1":      exnet.ErrDenied,
+		"2001:db8::1":      exnet.ErrDenied,
+		"::ffff:127.0.0.1": exnet.ErrDenied,
+	} {
+		assert.Equal(t, want, p.Allow(connFrom(ip)), ip)
+	}
+	assert.NoError(t, p.Allow(testAddrConn{addr: &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}}))
+
+	// deny only
+	assert.NoError(t, p.Update(&exnet.CIDRPolicyConfig{Deny: deny}))
+	assert.NoError(t, p.Allow(connFrom("192.168.0.1")))
+	assert.Equal(t, exnet.ErrDenied, p.Allow(connFrom("10.0.0.1")))
+	assert.Equal(t, exnet.ErrNilConfig, p.Update(nil))
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	p := exnet.NewRateLimitPolicy(&exnet.RateLimitConfig{Rate: 10, Burst: 2, MaxSources: 2})
+
+	// burst, then a token every 100ms
+	assert.NoError(t, p.Allow(connFrom("10.0.0.1")))
+	assert.NoError(t, p.Allow(connFrom("10.0.0.1")))
+	assert.Equal(t, exnet.ErrRateLimited, p.Allow(connFrom("10.0.0.1")))
+	assert.NoError(t, p.Allow(connFrom("10.0.0.2")))
+	time.Sleep(120 * time.Millisecond)
+	assert.NoError(t, p.Allow(connFrom("10.0.0.1")))
+	assert.Equal(t, exnet.ErrRateLimited, p.Allow(connFrom("10.0.0.1")))
+
+	// the least recently seen source is forgotten and gets a full bucket
+	assert.NoError(t, p.Allow(connFrom("10.0.0.3")))
+	assert.Equal(t, 2, p.Sources())
+	assert.NoError(t, p.Allow(connFrom("10.0.0.2")))
+	assert.NoError(t, p.Allow(connFrom("10.0.0.2")))
+	assert.Equal(t, exnet.ErrRateLimited, p.Allow(connFrom("10.0.0.2")))
+
+	assert.NoError(t, p.Update(&exnet.RateLimitConfig{Rate: 10, Burst: 2, MaxSources: 1}))
+	assert.Equal(t, 1, p.Sources())
+}
+
+func TestListenerAcceptPolicy(t *testing.T) {
+	skipWithoutLoopback(t, "127.0.0.2")
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	rejected := make(chan error, 10)
+	lis.SetTracer(exnet.TraceReject(func(conn net.Conn, err error) { rejected <- err }))
+	deny, _ := exnet.ParseCIDRs("127.0.0.2")
+	cidr := exnet.NewCIDRPolicy(&exnet.CIDRPolicyConfig{Deny: deny})
+	lis.SetAcceptPolicy(exnet.AcceptPolicies(
+		cidr,
+		exnet.NewRateLimitPolicy(&exnet.RateLimitConfig{Rate: 0.001, Burst: 1}),
+	))
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func(local string) net.Conn {
+		d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+		conn, err := d.Dial("tcp", lis.Addr().String())
+		assert.NoError(t, err)
+		return conn
+	}
+	expectClosed := func(conn net.Conn) {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		conn.Close()
+	}
+
+	expectClosed(dial("127.0.0.2"))
+	assert.Equal(t, exnet.ErrDenied, <-rejected)
+	conn := dial("127.0.0.1")
+	defer conn.Close()
+	(<-accepted).Close()
+	expectClosed(dial("127.0.0.1"))
+	assert.Equal(t, exnet.ErrRateLimited, <-rejected)
+
+	// reload at runtime
+	assert.NoError(t, cidr.Update(&exnet.CIDRPolicyConfig{}))
+	conn = dial("127.0.0.2")
+	defer conn.Close()
+	(<-accepted).Close()
+	lis.SetAcceptPolicy(nil)
+	conn = dial("127.0.0.1")
+	defer conn.Close()
+	(<-accepted).Close()
+	assert.Equal(t, int64(2), lis.Metrics()["rejected_policy"])
+}
@@ -0,0 +1,323 @@
+package exnet_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+// echoServer echo data of every connection
+func echoServer(t *testing.T) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return lis
+}
+
+// testProxy is an in-process proxy, targets are the addresses requested,
+// host names are resolved by hosts.
+type testProxy struct {
+	net.Listener
+	user, pass string
+	hosts      map[string]string
+	targets    chan string
+}
+
+func newTestProxy(t *testing.T, serve func(p *testProxy, conn net.Conn)) *testProxy {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	p := &testProxy{Listener: lis, hosts: make(map[string]string), targets: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serve(p, conn)
+		}
+	}()
+	return p
+}
+
+// relay connect to target and copy data in both directions
+func (p *testProxy) relay(conn net.Conn, target string) net.Conn {
+	p.targets <- target
+	host, port, _ := net.SplitHostPort(target)
+	if ip, ok := p.hosts[host]; ok {
+		target = net.JoinHostPort(ip, port)
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil
+	}
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	return upstream
+}
+
+func serveSOCKS5(p *testProxy, conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	methods := buf[2 : 2+buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if p.user != "" {
+		if !strings.Contains(string(methods), "\x02") {
+			_, _ = conn.Write([]byte{5, 0xff})
+			return
+		}
+		_, _ = conn.Write([]byte{5, 2})
+		r := bufio.NewReader(conn)
+		_, _ = r.ReadByte()
+		n, _ := r.ReadByte()
+		user := make([]byte, n)
+		_, _ = io.ReadFull(r, user)
+		n, _ = r.ReadByte()
+		pass := make([]byte, n)
+		_, _ = io.ReadFull(r, pass)
+		if string(user) != p.user || string(pass) != p.pass {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	} else {
+		_, _ = conn.Write([]byte{5, 0})
+	}
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		_, _ = io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 4:
+		_, _ = io.ReadFull(conn, buf[:16])
+		host = net.IP(buf[:16]).String()
+	case 3:
+		_, _ = io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		_, _ = io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	}
+	_, _ = io.ReadFull(conn, buf[:2])
+	port := int(buf[0])<<8 | int(buf[1])
+	upstream := p.relay(conn, net.JoinHostPort(host, strconv.Itoa(port)))
+	if upstream == nil {
+		// connection refused
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	_, _ = io.Copy(conn, upstream)
+}
+
+func serveHTTPConnect(p *testProxy, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if p.user != "" {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.pass))
+		if req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+	}
+	upstream := p.relay(conn, req.Host)
+	if upstream == nil {
+		_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer upstream.Close()
+	// data of the target right after the response
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	_, _ = io.Copy(conn, upstream)
+}
+
+func assertEcho(t *testing.T, conn net.Conn, prefix string) {
+	_, err := conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, len(prefix)+4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, prefix+"ping", string(buf))
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	proxy := newTestProxy(t, serveSOCKS5)
+	defer proxy.Close()
+	proxy.user, proxy.pass = "user", "secret"
+	proxy.hosts["echo.test"] = "127.0.0.1"
+
+	conf, err := exnet.ParseProxyURL("socks5h://user:secret@" + proxy.Addr().String())
+	assert.NoError(t, err)
+	d := &exnet.Dialer{}
+	d.SetProxy(conf)
+
+	// resolved by proxy
+	target := net.JoinHostPort("echo.test", port)
+	conn, err := d.Dial("tcp", target)
+	if assert.NoError(t, err) {
+		assert.Equal(t, target, <-proxy.targets)
+		assert.Equal(t, target, conn.RemoteAddr().String())
+		var written int
+		assert.NoError(t, exnet.TraceConn(conn, exnet.TraceWrite(func(conn net.Conn, data []byte, err error) {
+			written += len(data)
+		})))
+		assertEcho(t, conn, "")
+		assert.Equal(t, 4, written)
+		conn.Close()
+	}
+
+	// resolved locally
+	conf.RemoteDNS = false
+	tr := &testResolver{hosts: map[string][]string{"local.test": {"127.0.0.1"}}}
+	d.SetResolver(tr)
+	conn, err = d.Dial("tcp", net.JoinHostPort("local.test", port))
+	if assert.NoError(t, err) {
+		assert.Equal(t, echo.Addr().String(), <-proxy.targets)
+		assert.Equal(t, echo.Addr().String(), conn.RemoteAddr().String())
+		assertEcho(t, conn, "")
+		conn.Close()
+	}
+
+	// target refused
+	_, err = d.Dial("tcp", "127.0.0.1:1")
+	assert.Error(t, err)
+	<-proxy.targets
+
+	conf.Password = "wrong"
+	_, err = d.Dial("tcp", echo.Addr().String())
+	assert.True(t, errors.Is(err, exnet.ErrProxyAuth), "%v", err)
+	conf.Username = ""
+	_, err = d.Dial("tcp", echo.Addr().String())
+	assert.True(t, errors.Is(err, exnet.ErrProxyAuth), "%v", err)
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := newTestProxy(t, serveHTTPConnect)
+	defer proxy.Close()
+	proxy.user, proxy.pass = "user", "secret"
+
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", echo.Addr().String()))
+	conf := &exnet.ProxyConfig{Type: exnet.ProxyHTTP, Address: proxy.Addr().String(), Username: "user", Password: "secret"}
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:   time.Second,
+		AddressPicker: ap,
+		Proxy:         conf,
+	})
+	conn, err := cluster.Dial("tcp", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, echo.Addr().String(), <-proxy.targets)
+		assert.Equal(t, echo.Addr().String(), conn.RemoteAddr().String())
+		// data after the response is replayed
+		assertEcho(t, conn, "hello")
+		conn.Close()
+	}
+
+	cconf := cluster.Config()
+	cconf.Proxy = &exnet.ProxyConfig{Type: exnet.ProxyHTTP, Address: proxy.Addr().String()}
+	assert.NoError(t, cluster.Update(cconf))
+	_, err = cluster.Dial("tcp", "")
+	assert.True(t, errors.Is(err, exnet.ErrProxyAuth), "%v", err)
+}
+
+func TestClusterProxyPool(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := newTestProxy(t, serveHTTPConnect)
+	defer proxy.Close()
+
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", echo.Addr().String()))
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:   time.Second,
+		AddressPicker: ap,
+		PoolConfig:    &exnet.ConnPoolConfig{Cap: 1},
+		Proxy:         &exnet.ProxyConfig{Type: exnet.ProxyHTTP, Address: proxy.Addr().String()},
+	})
+	conn, err := cluster.Dial("tcp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, echo.Addr().String(), <-proxy.targets)
+	assert.NoError(t, cluster.Close(conn))
+
+	// the pooled connection keeps its target and the data not read yet
+	conn, err = cluster.Dial("tcp", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), cluster.Metrics()["dial_pool_reuse"])
+		assert.Equal(t, echo.Addr().String(), conn.RemoteAddr().String())
+		assert.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+		assertEcho(t, conn, "hello")
+		conn.Close()
+	}
+	assert.Len(t, proxy.targets, 0)
+}
+
+func TestDialProxyTimeout(t *testing.T) {
+	// a proxy never responds
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+
+	d := &exnet.Dialer{}
+	d.SetProxy(&exnet.ProxyConfig{Type: exnet.ProxySOCKS5, Address: lis.Addr().String()})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = d.DialContext(ctx, "tcp", "127.0.0.1:80")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestParseProxyURL(t *testing.T) {
+	conf, err := exnet.ParseProxyURL("http://a:b@proxy.test:3128")
+	assert.NoError(t, err)
+	assert.Equal(t, &exnet.ProxyConfig{Type: exnet.ProxyHTTP, Address: "proxy.test:3128", Username: "a", Password: "b"}, conf)
+	for _, u := range []string{"ftp://proxy.test:21", "socks5://proxy.test", "://"} {
+		_, err = exnet.ParseProxyURL(u)
+		assert.Error(t, err, u)
+	}
+}
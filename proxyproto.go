@@ -0,0 +1,467 @@
+package exnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultProxyHeaderTimeout = 5 * time.Second
+
+	// max length of a v1 header including CRLF
+	proxyV1MaxLen = 107
+	// max length of a v2 header accepted, address block and TLVs included
+	proxyV2MaxLen = 16 + 1024
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyCommand is the command of a PROXY protocol v2 header
+type ProxyCommand byte
+
+// Commands of PROXY protocol
+const (
+	// ProxyLocal means the connection is established by the proxy itself,
+	// e.g. health checks, addresses of the connection are kept.
+	ProxyLocal ProxyCommand = 0x0
+	// ProxyProxy means the connection is relayed on behalf of a client
+	ProxyProxy ProxyCommand = 0x1
+)
+
+// ProxyTLV is a type-length-value vector of PROXY protocol v2
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a HAProxy PROXY protocol header
+type ProxyHeader struct {
+	// Version is 1 (text) or 2 (binary)
+	Version int
+	Command ProxyCommand
+	// Source and Destination are addresses of the client connection, nil
+	// if unknown. They are *net.TCPAddr, *net.UDPAddr or *net.UnixAddr.
+	Source      net.Addr
+	Destination net.Addr
+	// TLVs of a v2 header
+	TLVs []ProxyTLV
+}
+
+// ProxyProtocolConfig config for PROXY protocol on Listener
+type ProxyProtocolConfig struct {
+	// Trusted is the upstreams allowed to send PROXY headers, e.g. load
+	// balancers. Connections from other addresses are accepted as is, and a
+	// header sent by them is not parsed. Empty means no upstream is
+	// trusted, use 0.0.0.0/0 and ::/0 to trust all of them.
+	Trusted []*net.IPNet
+	// Timeout is the max duration to read a header, default is 5 seconds
+	Timeout time.Duration
+	// Optional accepts connections without header from trusted upstreams,
+	// otherwise they are rejected.
+	Optional bool
+}
+
+type proxyHeaderKey struct{}
+
+// NewProxyHeader create a PROXY header of version relaying a connection from
+// src to dst, e.g. the remote and local address of an accepted connection.
+func NewProxyHeader(version int, src, dst net.Addr) *ProxyHeader {
+	return &ProxyHeader{
+		Version:     version,
+		Command:     ProxyProxy,
+		Source:      src,
+		Destination: dst,
+	}
+}
+
+// WithProxyHeader return a context to dial with, Dialer and Cluster send h
+// on the connection before any other data. Connections with a header are
+// never pooled, as they carry the identity of a single client.
+func WithProxyHeader(ctx context.Context, h *ProxyHeader) context.Context {
+	return context.WithValue(ctx, proxyHeaderKey{}, h)
+}
+
+func proxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	h, _ := ctx.Value(proxyHeaderKey{}).(*ProxyHeader)
+	return h
+}
+
+// ProxyHeaderOf return PROXY header received on conn accepted by an
+// exnet.Listener, or sent on conn dialed by Dialer or Cluster, false if conn
+// has no header.
+func ProxyHeaderOf(conn net.Conn) (*ProxyHeader, bool) {
+	c, ok := conn.(*Conn)
+	if !ok || c.proxyHeader == nil {
+		return nil, false
+	}
+	return c.proxyHeader, true
+}
+
+// ParseCIDRs parse CIDRs like "10.0.0.0/8" or "fd00::/8", a single IP is
+// taken as a /32 or /128 network.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Format encode the header
+func (h *ProxyHeader) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	}
+	return nil, fmt.Errorf("%w: unknown version %d", ErrInvalidProxyHeader, h.Version)
+}
+
+// WriteTo write the encoded header to w
+func (h *ProxyHeader) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *ProxyHeader) formatV1() ([]byte, error) {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	if h.Command == ProxyLocal || !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+			src.IP.To4(), dst.IP.To4(), src.Port, dst.Port)), nil
+	}
+	// both addresses must be IPv6, write IPv4 ones as mapped
+	ip6 := func(ip net.IP) string {
+		if ip4 := ip.To4(); ip4 != nil {
+			return "::ffff:" + ip4.String()
+		}
+		return ip.String()
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+		ip6(src.IP), ip6(dst.IP), src.Port, dst.Port)), nil
+}
+
+func (h *ProxyHeader) formatV2() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x20 | byte(h.Command&0xf))
+
+	var family byte
+	var addrs []byte
+	if h.Command == ProxyProxy {
+		family, addrs = proxyV2Addrs(h.Source, h.Destination)
+	}
+	buf.WriteByte(family)
+	length := len(addrs)
+	for _, tlv := range h.TLVs {
+		length += 3 + len(tlv.Value)
+	}
+	if length > 0xffff {
+		return nil, fmt.Errorf("%w: too long", ErrInvalidProxyHeader)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, uint16(length))
+	buf.Write(addrs)
+	for _, tlv := range h.TLVs {
+		buf.WriteByte(tlv.Type)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(tlv.Value)))
+		buf.Write(tlv.Value)
+	}
+	return buf.Bytes(), nil
+}
+
+// proxyV2Addrs return address family and address block of src and dst,
+// family is unspecified if they are unknown or of different kinds.
+func proxyV2Addrs(src, dst net.Addr) (byte, []byte) {
+	ipPort := func(a net.Addr) (net.IP, int, byte, bool) {
+		switch a := a.(type) {
+		case *net.TCPAddr:
+			return a.IP, a.Port, 0x1, true
+		case *net.UDPAddr:
+			return a.IP, a.Port, 0x2, true
+		}
+		return nil, 0, 0, false
+	}
+	if su, ok := src.(*net.UnixAddr); ok {
+		du, ok := dst.(*net.UnixAddr)
+		if !ok || len(su.Name) > 108 || len(du.Name) > 108 {
+			return 0, nil
+		}
+		addrs := make([]byte, 216)
+		copy(addrs, su.Name)
+		copy(addrs[108:], du.Name)
+		proto := byte(0x1)
+		if su.Net == "unixgram" {
+			proto = 0x2
+		}
+		return 0x30 | proto, addrs
+	}
+	srcIP, srcPort, srcProto, srcOK := ipPort(src)
+	dstIP, dstPort, dstProto, dstOK := ipPort(dst)
+	if !srcOK || !dstOK || srcProto != dstProto {
+		return 0, nil
+	}
+	var addrs []byte
+	family := byte(0x10)
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+	} else {
+		family = 0x20
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(srcPort))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstPort))
+	return family | srcProto, append(addrs, ports...)
+}
+
+// ReadProxyHeader read a PROXY protocol v1 or v2 header from r, it reads
+// nothing after the header.
+func ReadProxyHeader(r io.Reader) (*ProxyHeader, error) {
+	sig := make([]byte, len(proxyV1Signature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV1Signature) {
+		return readProxyHeaderV1(r)
+	}
+	if bytes.Equal(sig, proxyV2Signature[:len(sig)]) {
+		return readProxyHeaderV2(r, sig)
+	}
+	return nil, ErrNoProxyHeader
+}
+
+func readProxyHeaderV1(r io.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) > proxyV1MaxLen-len(proxyV1Signature) {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header not ends with CRLF", ErrInvalidProxyHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1, Command: ProxyProxy}
+	if fields[0] == "UNKNOWN" {
+		h.Command = ProxyLocal
+		return h, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidProxyHeader, line)
+	}
+	parse := func(ip, port string) (*net.TCPAddr, error) {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+		if addr.IP == nil || (fields[0] == "TCP4") == strings.Contains(ip, ":") {
+			return nil, fmt.Errorf("%w: invalid v1 address %q", ErrInvalidProxyHeader, ip)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid v1 port %q", ErrInvalidProxyHeader, port)
+		}
+		addr.Port = int(p)
+		return addr, nil
+	}
+	var err error
+	if h.Source, err = parse(fields[1], fields[3]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parse(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func readProxyHeaderV2(r io.Reader, sig []byte) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	copy(fixed, sig)
+	if _, err := io.ReadFull(r, fixed[len(sig):]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyV2Signature) {
+		return nil, ErrNoProxyHeader
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unknown v2 version %d", ErrInvalidProxyHeader, fixed[12]>>4)
+	}
+	length := int(binary.BigEndian.Uint16(fixed[14:]))
+	if 16+length > proxyV2MaxLen {
+		return nil, fmt.Errorf("%w: v2 header too long", ErrInvalidProxyHeader)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2, Command: ProxyCommand(fixed[12] & 0xf)}
+	switch h.Command {
+	case ProxyLocal, ProxyProxy:
+	default:
+		return nil, fmt.Errorf("%w: unknown v2 command %d", ErrInvalidProxyHeader, h.Command)
+	}
+	family, proto := fixed[13]>>4, fixed[13]&0xf
+	var n int
+	switch family {
+	case 0x0:
+	case 0x1, 0x2:
+		size := net.IPv4len
+		if family == 0x2 {
+			size = net.IPv6len
+		}
+		n = 2*size + 4
+		if len(body) < n {
+			return nil, fmt.Errorf("%w: v2 address block too short", ErrInvalidProxyHeader)
+		}
+		srcIP := net.IP(append([]byte(nil), body[:size]...))
+		dstIP := net.IP(append([]byte(nil), body[size:2*size]...))
+		srcPort := int(binary.BigEndian.Uint16(body[2*size:]))
+		dstPort := int(binary.BigEndian.Uint16(body[2*size+2:]))
+		switch proto {
+		case 0x1:
+			h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+			h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+		case 0x2:
+			h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+			h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+		}
+	case 0x3:
+		n = 216
+		if len(body) < n {
+			return nil, fmt.Errorf("%w: v2 address block too short", ErrInvalidProxyHeader)
+		}
+		network := "unix"
+		if proto == 0x2 {
+			network = "unixgram"
+		}
+		name := func(b []byte) string {
+			if i := bytes.IndexByte(b, 0); i >= 0 {
+				b = b[:i]
+			}
+			return string(b)
+		}
+		h.Source = &net.UnixAddr{Name: name(body[:108]), Net: network}
+		h.Destination = &net.UnixAddr{Name: name(body[108:216]), Net: network}
+	default:
+		return nil, fmt.Errorf("%w: unknown v2 address family %d", ErrInvalidProxyHeader, family)
+	}
+
+	for tlvs := body[n:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated v2 TLV", ErrInvalidProxyHeader)
+		}
+		size := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+size {
+			return nil, fmt.Errorf("%w: truncated v2 TLV", ErrInvalidProxyHeader)
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: append([]byte{}, tlvs[3:3+size]...)})
+		tlvs = tlvs[3+size:]
+	}
+	return h, nil
+}
+
+// proxyConn is a connection whose addresses are from a PROXY header, the
+// data read while looking for a header is replayed.
+type proxyConn struct {
+	replayConn
+	header *ProxyHeader
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.header != nil && c.header.Command == ProxyProxy && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.Command == ProxyProxy && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// recordReader keeps all data read from r
+type recordReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (rr *recordReader) Read(b []byte) (int, error) {
+	n, err := rr.r.Read(b)
+	rr.buf = append(rr.buf, b[:n]...)
+	return n, err
+}
+
+// readProxyHeader read PROXY header from a connection accepted from a
+// trusted upstream.
+func (conf *ProxyProtocolConfig) readProxyHeader(rwc net.Conn) (*proxyConn, error) {
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	if err := rwc.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	rr := &recordReader{r: rwc}
+	h, err := ReadProxyHeader(rr)
+	if err == nil {
+		err = rwc.SetReadDeadline(time.Time{})
+	}
+	if err == ErrNoProxyHeader && conf.Optional {
+		// not a header, replay what is read
+		if err = rwc.SetReadDeadline(time.Time{}); err == nil {
+			return &proxyConn{replayConn: replayConn{Conn: rwc, rest: rr.buf}}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{replayConn: replayConn{Conn: rwc}, header: h}, nil
+}
+
+// trusted report whether addr is allowed to send PROXY headers
+func (conf *ProxyProtocolConfig) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(conf.Trusted, tcpAddr.IP)
+}
@@ -0,0 +1,249 @@
+package exnet_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 56324}
+
+	b, err := exnet.NewProxyHeader(1, src, dst).Format()
+	assert.NoError(t, err)
+	assert.Equal(t, "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n", string(b))
+	b, err = exnet.NewProxyHeader(1, src6, dst).Format()
+	assert.NoError(t, err)
+	assert.Equal(t, "PROXY TCP6 fd00::1 ::ffff:10.0.0.1 56324 443\r\n", string(b))
+
+	headers := []*exnet.ProxyHeader{
+		exnet.NewProxyHeader(1, src, dst),
+		exnet.NewProxyHeader(2, src, dst),
+		exnet.NewProxyHeader(2, src6, &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 443}),
+		exnet.NewProxyHeader(2, &net.UDPAddr{IP: src.IP.To4(), Port: 53}, &net.UDPAddr{IP: dst.IP.To4(), Port: 53}),
+		exnet.NewProxyHeader(2, &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/tmp/b.sock", Net: "unix"}),
+		{Version: 2, Command: exnet.ProxyLocal},
+		{
+			Version:     2,
+			Command:     exnet.ProxyProxy,
+			Source:      src,
+			Destination: dst,
+			TLVs:        []exnet.ProxyTLV{{Type: 0x02, Value: []byte("example.com")}, {Type: 0x30, Value: []byte{}}},
+		},
+	}
+	for _, h := range headers {
+		b, err := h.Format()
+		assert.NoError(t, err)
+		r := bytes.NewReader(append(b, "payload"...))
+		got, err := exnet.ReadProxyHeader(r)
+		if !assert.NoError(t, err, "%q", b) {
+			continue
+		}
+		assert.Equal(t, h.Version, got.Version)
+		assert.Equal(t, h.Command, got.Command)
+		if h.Source != nil {
+			assert.Equal(t, h.Source.String(), got.Source.String())
+			assert.Equal(t, h.Destination.String(), got.Destination.String())
+		}
+		assert.Equal(t, len(h.TLVs), len(got.TLVs))
+		for i := range got.TLVs {
+			assert.Equal(t, h.TLVs[i].Type, got.TLVs[i].Type)
+			assert.Equal(t, h.TLVs[i].Value, got.TLVs[i].Value)
+		}
+		// nothing after the header is read
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, "payload", string(rest))
+	}
+
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n",
+		"PROXY TCP4 fd00::1 10.0.0.1 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443 " + string(bytes.Repeat([]byte("x"), 100)) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04abcd",
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+	} {
+		_, err := exnet.ReadProxyHeader(bytes.NewReader([]byte(bad)))
+		assert.Error(t, err, "%q", bad)
+	}
+	_, err = exnet.ReadProxyHeader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+	assert.Equal(t, exnet.ErrNoProxyHeader, err)
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	trusted, err := exnet.ParseCIDRs("127.0.0.0/8")
+	assert.NoError(t, err)
+	lis.SetProxyProtocol(&exnet.ProxyProtocolConfig{
+		Trusted: trusted,
+		Timeout: 100 * time.Millisecond,
+	})
+	traced := make(chan error, 10)
+	lis.SetTracer(exnet.TraceProxyHeader(func(conn net.Conn, header *exnet.ProxyHeader, err error) {
+		traced <- err
+	}))
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	frontend := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	for _, version := range []int{1, 2} {
+		h := exnet.NewProxyHeader(version, client, frontend)
+		conn, err := (&exnet.Dialer{}).DialContext(exnet.WithProxyHeader(context.Background(), h), "tcp", lis.Addr().String())
+		if !assert.NoError(t, err) {
+			continue
+		}
+		sent, ok := exnet.ProxyHeaderOf(conn)
+		assert.True(t, ok)
+		assert.Equal(t, h, sent)
+		_, err = conn.Write(cmsg)
+		assert.NoError(t, err)
+
+		sconn := <-accepted
+		assert.NoError(t, <-traced)
+		assert.Equal(t, client.String(), sconn.RemoteAddr().String())
+		assert.Equal(t, frontend.String(), sconn.LocalAddr().String())
+		got, ok := exnet.ProxyHeaderOf(sconn)
+		assert.True(t, ok)
+		assert.Equal(t, version, got.Version)
+		buf := make([]byte, len(cmsg))
+		_, err = io.ReadFull(sconn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, cmsg, buf)
+		sconn.Close()
+		conn.Close()
+	}
+
+	// a trusted upstream without header is rejected, the listener goes on
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, exnet.ErrNoProxyHeader, <-traced)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	conn.Close()
+
+	// a silent one times out
+	conn, err = net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	assert.Error(t, <-traced)
+	conn.Close()
+	assert.Len(t, accepted, 0)
+}
+
+func TestListenerProxyProtocolUntrusted(t *testing.T) {
+	trusted, err := exnet.ParseCIDRs("10.0.0.0/8", "fd00::1")
+	assert.NoError(t, err)
+	t.Run("Others", func(t *testing.T) { testListenerProxyProtocolUntrusted(t, trusted) })
+	// no upstream is trusted by default
+	t.Run("Empty", func(t *testing.T) { testListenerProxyProtocolUntrusted(t, nil) })
+}
+
+func testListenerProxyProtocolUntrusted(t *testing.T, trusted []*net.IPNet) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	lis.SetProxyProtocol(&exnet.ProxyProtocolConfig{Trusted: trusted})
+
+	h := exnet.NewProxyHeader(1, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443})
+	conn, err := (&exnet.Dialer{}).DialContext(exnet.WithProxyHeader(context.Background(), h), "tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// the header from an untrusted upstream is passed as data
+	sconn, err := lis.Accept()
+	assert.NoError(t, err)
+	defer sconn.Close()
+	assert.Equal(t, conn.LocalAddr().String(), sconn.RemoteAddr().String())
+	_, ok := exnet.ProxyHeaderOf(sconn)
+	assert.False(t, ok)
+	b, _ := h.Format()
+	buf := make([]byte, len(b))
+	_, err = io.ReadFull(sconn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, b, buf)
+}
+
+func TestListenerProxyProtocolSlowClient(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	trusted, err := exnet.ParseCIDRs("127.0.0.0/8")
+	assert.NoError(t, err)
+	lis.SetProxyProtocol(&exnet.ProxyProtocolConfig{Trusted: trusted, Timeout: 5 * time.Second})
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// a client which never sends its header doesn't hold up others
+	slow, err := net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	defer slow.Close()
+	h := exnet.NewProxyHeader(2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443})
+	conn, err := (&exnet.Dialer{}).DialContext(exnet.WithProxyHeader(context.Background(), h), "tcp", lis.Addr().String())
+	if assert.NoError(t, err) {
+		defer conn.Close()
+	}
+	select {
+	case sconn := <-accepted:
+		assert.Equal(t, "203.0.113.7:40000", sconn.RemoteAddr().String())
+		sconn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("header parsing is blocked by a slow client")
+	}
+}
+
+func TestListenerProxyProtocolOptional(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	trusted, err := exnet.ParseCIDRs("127.0.0.0/8")
+	assert.NoError(t, err)
+	lis.SetProxyProtocol(&exnet.ProxyProtocolConfig{Trusted: trusted, Optional: true})
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(cmsg)
+	assert.NoError(t, err)
+
+	sconn, err := lis.Accept()
+	assert.NoError(t, err)
+	defer sconn.Close()
+	assert.Equal(t, conn.LocalAddr().String(), sconn.RemoteAddr().String())
+	buf := make([]byte, len(cmsg))
+	_, err = io.ReadFull(sconn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, cmsg, buf)
+}
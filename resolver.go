@@ -0,0 +1,238 @@
+package exnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDNSCacheTTL        = time.Minute
+	defaultDNSLookupTimeout   = 5 * time.Second
+	defaultDNSCacheMaxEntries = 10000
+)
+
+// Resolver looks up IP addresses of a host, net.Resolver implements it
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TTLResolver is a Resolver which knows TTL of the records, DNSCache caches
+// the addresses for the TTL.
+type TTLResolver interface {
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// DNSCacheConfig config for DNSCache
+type DNSCacheConfig struct {
+	// Resolver to look up addresses, default is net.DefaultResolver
+	Resolver Resolver
+	// TTL of addresses if Resolver is not a TTLResolver, default is 1
+	// minute.
+	TTL time.Duration
+	// StaleTTL is the max duration an expired entry is served, while it's
+	// refreshed in background, or the lookup fails. 0 disables it.
+	StaleTTL time.Duration
+	// NegativeTTL caches hosts not found for the duration, 0 disables it.
+	// Other failures, e.g. timeouts, are not cached.
+	NegativeTTL time.Duration
+	// LookupTimeout is the timeout of lookups in background, default is 5
+	// seconds.
+	LookupTimeout time.Duration
+	// MaxEntries is the max number of hosts cached, default is 10000
+	MaxEntries int
+}
+
+// DNSCache is a Resolver caching addresses of hosts, concurrent lookups of
+// a host share one lookup. Set it to Dialer by SetResolver.
+type DNSCache struct {
+	conf     DNSCacheConfig
+	resolver Resolver
+
+	mtx     sync.Mutex
+	entries map[string]*dnsEntry
+	calls   map[string]*dnsCall
+
+	// metrics
+	metricHits         int64
+	metricStaleHits    int64
+	metricNegativeHits int64
+	metricMisses       int64
+	metricLookups      int64
+	metricLookupErrors int64
+}
+
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// dnsCall is a lookup in progress, done is closed when it finishes
+type dnsCall struct {
+	done  chan struct{}
+	addrs []net.IPAddr
+	err   error
+}
+
+// NewDNSCache create a DNSCache
+func NewDNSCache(conf *DNSCacheConfig) *DNSCache {
+	if conf == nil {
+		panic("DNSCacheConfig can't be nil")
+	}
+	r := &DNSCache{
+		conf:     *conf,
+		resolver: conf.Resolver,
+		entries:  make(map[string]*dnsEntry),
+		calls:    make(map[string]*dnsCall),
+	}
+	if r.resolver == nil {
+		r.resolver = net.DefaultResolver
+	}
+	if r.conf.TTL <= 0 {
+		r.conf.TTL = defaultDNSCacheTTL
+	}
+	if r.conf.LookupTimeout <= 0 {
+		r.conf.LookupTimeout = defaultDNSLookupTimeout
+	}
+	if r.conf.MaxEntries <= 0 {
+		r.conf.MaxEntries = defaultDNSCacheMaxEntries
+	}
+	return r
+}
+
+// LookupIPAddr implement Resolver interface, return cached addresses of
+// host if they are not expired, or stale ones while refreshing them.
+func (r *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	r.mtx.Lock()
+	e := r.entries[host]
+	if e != nil && now.Before(e.expires) {
+		r.mtx.Unlock()
+		if e.err != nil {
+			atomic.AddInt64(&r.metricNegativeHits, 1)
+			return nil, e.err
+		}
+		atomic.AddInt64(&r.metricHits, 1)
+		return e.addrs, nil
+	}
+	stale := e != nil && e.err == nil && now.Before(e.expires.Add(r.conf.StaleTTL))
+	call := r.lookup(host)
+	r.mtx.Unlock()
+
+	if stale {
+		atomic.AddInt64(&r.metricStaleHits, 1)
+		return e.addrs, nil
+	}
+	atomic.AddInt64(&r.metricMisses, 1)
+	select {
+	case <-call.done:
+		return call.addrs, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup return the lookup in progress of host, or start one, caller must
+// hold mtx. The lookup is not canceled by callers, as it's shared, and
+// the result is cached.
+func (r *DNSCache) lookup(host string) *dnsCall {
+	if call, ok := r.calls[host]; ok {
+		return call
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	r.calls[host] = call
+	go func() {
+		atomic.AddInt64(&r.metricLookups, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), r.conf.LookupTimeout)
+		defer cancel()
+		ttl := r.conf.TTL
+		var addrs []net.IPAddr
+		var err error
+		if tr, ok := r.resolver.(TTLResolver); ok {
+			addrs, ttl, err = tr.LookupIPAddrTTL(ctx, host)
+		} else {
+			addrs, err = r.resolver.LookupIPAddr(ctx, host)
+		}
+		if err == nil && len(addrs) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		if err != nil {
+			atomic.AddInt64(&r.metricLookupErrors, 1)
+		}
+
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		delete(r.calls, host)
+		call.addrs, call.err = addrs, err
+		now := time.Now()
+		switch {
+		case err == nil:
+			r.store(host, &dnsEntry{addrs: addrs, expires: now.Add(ttl)})
+		case isNotFound(err) && r.conf.NegativeTTL > 0:
+			r.store(host, &dnsEntry{err: err, expires: now.Add(r.conf.NegativeTTL)})
+		default:
+			// serve stale addresses if the lookup failed
+			if e := r.entries[host]; e != nil && e.err == nil && now.Before(e.expires.Add(r.conf.StaleTTL)) {
+				call.addrs, call.err = e.addrs, nil
+			}
+		}
+		close(call.done)
+	}()
+	return call
+}
+
+// store an entry, expired entries are removed if the cache is full, caller
+// must hold mtx.
+func (r *DNSCache) store(host string, e *dnsEntry) {
+	if _, ok := r.entries[host]; !ok && len(r.entries) >= r.conf.MaxEntries {
+		now := time.Now()
+		for h, old := range r.entries {
+			if now.After(old.expires.Add(r.conf.StaleTTL)) {
+				delete(r.entries, h)
+			}
+		}
+		// remove an arbitrary one if none is expired
+		for h := range r.entries {
+			if len(r.entries) < r.conf.MaxEntries {
+				break
+			}
+			delete(r.entries, h)
+		}
+	}
+	r.entries[host] = e
+}
+
+// Invalidate remove host from cache, all hosts if host is empty
+func (r *DNSCache) Invalidate(host string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if host == "" {
+		r.entries = make(map[string]*dnsEntry)
+		return
+	}
+	delete(r.entries, host)
+}
+
+// Metrics of cache
+func (r *DNSCache) Metrics() map[string]int64 {
+	r.mtx.Lock()
+	entries := len(r.entries)
+	r.mtx.Unlock()
+	return map[string]int64{
+		"entries":       int64(entries),
+		"hits":          atomic.LoadInt64(&r.metricHits),
+		"stale_hits":    atomic.LoadInt64(&r.metricStaleHits),
+		"negative_hits": atomic.LoadInt64(&r.metricNegativeHits),
+		"misses":        atomic.LoadInt64(&r.metricMisses),
+		"lookups":       atomic.LoadInt64(&r.metricLookups),
+		"lookup_errors": atomic.LoadInt64(&r.metricLookupErrors),
+	}
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
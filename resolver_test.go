@@ -0,0 +1,259 @@
+package exnet_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+// testResolver resolves hosts from a map, hosts not in it are not found
+type testResolver struct {
+	mtx     sync.Mutex
+	hosts   map[string][]string
+	err     error
+	ttl     time.Duration
+	delay   time.Duration
+	lookups int64
+}
+
+func (r *testResolver) set(host string, ips ...string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.hosts[host] = ips
+}
+
+func (r *testResolver) setErr(err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.err = err
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt64(&r.lookups, 1)
+	time.Sleep(r.delay)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+type testTTLResolver struct {
+	*testResolver
+}
+
+func (r testTTLResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	return addrs, r.ttl, err
+}
+
+func lookupIPs(t *testing.T, r exnet.Resolver, host string) []string {
+	addrs, err := r.LookupIPAddr(context.Background(), host)
+	assert.NoError(t, err)
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips
+}
+
+func TestDNSCache(t *testing.T) {
+	tr := &testResolver{hosts: map[string][]string{"a.test": {"10.0.0.1"}}, delay: 50 * time.Millisecond}
+	cache := exnet.NewDNSCache(&exnet.DNSCacheConfig{Resolver: tr, TTL: 100 * time.Millisecond})
+
+	// concurrent lookups share one
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, []string{"10.0.0.1"}, lookupIPs(t, cache, "a.test"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&tr.lookups))
+
+	// cached until expired
+	tr.set("a.test", "10.0.0.2")
+	assert.Equal(t, []string{"10.0.0.1"}, lookupIPs(t, cache, "a.test"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.2"}, lookupIPs(t, cache, "a.test"))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&tr.lookups))
+
+	// waiters honor ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cache.LookupIPAddr(ctx, "b.test")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	metrics := cache.Metrics()
+	assert.Equal(t, int64(1), metrics["entries"])
+	assert.Equal(t, int64(12), metrics["misses"])
+	assert.Equal(t, int64(1), metrics["hits"])
+	assert.Equal(t, int64(3), metrics["lookups"])
+}
+
+func TestDNSCacheStale(t *testing.T) {
+	tr := &testResolver{hosts: map[string][]string{"a.test": {"10.0.0.1"}}, delay: 50 * time.Millisecond}
+	cache := exnet.NewDNSCache(&exnet.DNSCacheConfig{
+		Resolver: tr,
+		TTL:      50 * time.Millisecond,
+		StaleTTL: time.Second,
+	})
+	assert.Equal(t, []string{"10.0.0.1"}, lookupIPs(t, cache, "a.test"))
+	tr.set("a.test", "10.0.0.2")
+	time.Sleep(60 * time.Millisecond)
+
+	// served without waiting while refreshed
+	start := time.Now()
+	assert.Equal(t, []string{"10.0.0.1"}, lookupIPs(t, cache, "a.test"))
+	assert.True(t, time.Since(start) < 25*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(lookupIPs(t, cache, "a.test")) == 1 && lookupIPs(t, cache, "a.test")[0] == "10.0.0.2"
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, cache.Metrics()["stale_hits"] >= 1)
+
+	// served if the refresh fails
+	tr.setErr(errors.New("server failure"))
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.2"}, lookupIPs(t, cache, "a.test"))
+	cache.Invalidate("a.test")
+	_, err := cache.LookupIPAddr(context.Background(), "a.test")
+	assert.Error(t, err)
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	tr := &testResolver{hosts: map[string][]string{}}
+	cache := exnet.NewDNSCache(&exnet.DNSCacheConfig{
+		Resolver:    testTTLResolver{tr},
+		NegativeTTL: time.Hour,
+	})
+	for i := 0; i < 3; i++ {
+		_, err := cache.LookupIPAddr(context.Background(), "missing.test")
+		var dnsErr *net.DNSError
+		assert.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound, "%v", err)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&tr.lookups))
+	assert.Equal(t, int64(2), cache.Metrics()["negative_hits"])
+
+	// other failures are not cached
+	tr.setErr(errors.New("timeout"))
+	for i := 0; i < 2; i++ {
+		_, err := cache.LookupIPAddr(context.Background(), "other.test")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int64(3), atomic.LoadInt64(&tr.lookups))
+
+	// TTL from the resolver
+	tr.setErr(nil)
+	tr.ttl = 10 * time.Millisecond
+	tr.set("a.test", "10.0.0.1")
+	lookupIPs(t, cache, "a.test")
+	time.Sleep(20 * time.Millisecond)
+	lookupIPs(t, cache, "a.test")
+	assert.Equal(t, int64(5), atomic.LoadInt64(&tr.lookups))
+}
+
+func TestDialerResolver(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	// the first address refuses
+	tr := &testResolver{hosts: map[string][]string{"a.test": {"127.0.0.2", "127.0.0.1"}}}
+	cache := exnet.NewDNSCache(&exnet.DNSCacheConfig{Resolver: tr})
+	d := &exnet.Dialer{}
+	d.SetResolver(cache)
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial("tcp", net.JoinHostPort("a.test", port))
+		if assert.NoError(t, err) {
+			assert.Equal(t, lis.Addr().String(), conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&tr.lookups))
+
+	_, err = d.Dial("tcp6", net.JoinHostPort("a.test", port))
+	assert.Error(t, err)
+	_, err = d.Dial("tcp", net.JoinHostPort("missing.test", port))
+	var dnsErr *net.DNSError
+	assert.True(t, errors.As(err, &dnsErr), "%v", err)
+}
+
+func TestDialerFamilyPolicy(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	address := net.JoinHostPort("a.test", port)
+
+	// nothing listens on ::1
+	tr := &testResolver{hosts: map[string][]string{"a.test": {"127.0.0.1", "::1"}}}
+	d := &exnet.Dialer{}
+	d.SetResolver(tr)
+	d.SetFamilyPolicy(&addresspicker.FamilyConfig{Policy: addresspicker.IPv6Only})
+	_, err = d.Dial("tcp", address)
+	assert.Error(t, err)
+	d.SetFamilyPolicy(&addresspicker.FamilyConfig{Policy: addresspicker.PreferIPv6, Failures: 2, Cooldown: time.Hour})
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial("tcp", address)
+		if assert.NoError(t, err) {
+			assert.Equal(t, lis.Addr().String(), conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+	// IPv6 is not tried after it's broken
+	metrics := d.FamilyMetrics()
+	assert.Equal(t, int64(2), metrics["ipv6_failures"])
+	assert.Equal(t, int64(1), metrics["ipv6_broken"])
+	assert.Equal(t, int64(3), metrics["ipv4_successes"])
+
+	// an address doesn't connect in time, the next one is dialed after the
+	// fallback delay
+	tr.set("a.test", "100::1", "127.0.0.1")
+	d.SetFamilyPolicy(&addresspicker.FamilyConfig{Policy: addresspicker.HappyEyeballs, FallbackDelay: 50 * time.Millisecond})
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", address)
+	if assert.NoError(t, err) {
+		assert.Equal(t, lis.Addr().String(), conn.RemoteAddr().String())
+		assert.True(t, time.Since(start) < 500*time.Millisecond)
+		conn.Close()
+	}
+}
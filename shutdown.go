@@ -0,0 +1,131 @@
+package exnet
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	shutdownPollMin = 10 * time.Millisecond
+	shutdownPollMax = 500 * time.Millisecond
+)
+
+// listenerCloser removes accepted connections from their listener on Close
+type listenerCloser struct {
+	l *Listener
+}
+
+func (lc listenerCloser) Close(conn net.Conn) error {
+	c := conn.(*Conn)
+	l := lc.l
+	l.connsMtx.Lock()
+	if _, ok := l.conns[c]; ok {
+		delete(l.conns, c)
+		if ip := connIP(c); ip != "" {
+			if l.connsPerIP[ip]--; l.connsPerIP[ip] <= 0 {
+				delete(l.connsPerIP, ip)
+			}
+		}
+		l.slotCond().Broadcast()
+	}
+	l.connsMtx.Unlock()
+	return c._conn.Close()
+}
+
+// track add c to active connections, and release the slot reserved for it.
+// Return ErrListenerShutdown if the listener is shutting down, or an error
+// if c exceeds connection limits.
+func (l *Listener) track(c *Conn, reserved bool) error {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+
+	if reserved {
+		// wake waiters if c is not tracked and the slot is free again
+		l.reserved--
+		defer l.slotCond().Broadcast()
+	}
+	if atomic.LoadInt32(&l.shutdown) != 0 {
+		return ErrListenerShutdown
+	}
+	if err := l.checkLimit(c, reserved); err != nil {
+		return err
+	}
+	if l.conns == nil {
+		l.conns = make(map[*Conn]struct{})
+		l.connsPerIP = make(map[string]int)
+	}
+	l.conns[c] = struct{}{}
+	if ip := connIP(c); ip != "" {
+		l.connsPerIP[ip]++
+	}
+	c.closer = listenerCloser{l}
+	return nil
+}
+
+// ActiveConns return connections accepted and not closed yet
+func (l *Listener) ActiveConns() []net.Conn {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+
+	conns := make([]net.Conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// SetShutdownSignal set a function called on every active connection when
+// Shutdown starts, e.g. to close idle connections or tell peers to go away,
+// so they finish before Shutdown gives up on them.
+func (l *Listener) SetShutdownSignal(f func(net.Conn)) {
+	l.shutdownSignal = f
+}
+
+// Shutdown gracefully shuts down the listener: it stops accepting, closes
+// connections in PROXY header parsing or TLS handshake, calls the shutdown
+// signal on active connections, then waits for them to be closed. If ctx is
+// done before that, the remaining connections are closed and ctx.Err() is
+// returned. Accept returns ErrListenerShutdown after Shutdown called.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.connsMtx.Lock()
+	atomic.StoreInt32(&l.shutdown, 1)
+	l.slotCond().Broadcast()
+	l.closePreparing()
+	l.connsMtx.Unlock()
+
+	err := l._l.Close()
+	if l.shutdownSignal != nil {
+		for _, conn := range l.ActiveConns() {
+			l.shutdownSignal(conn)
+		}
+	}
+
+	interval := shutdownPollMin
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if l.activeCount() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			for _, conn := range l.ActiveConns() {
+				_ = conn.Close()
+			}
+			return ctx.Err()
+		case <-timer.C:
+			if interval *= 2; interval > shutdownPollMax {
+				interval = shutdownPollMax
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+func (l *Listener) activeCount() int {
+	l.connsMtx.Lock()
+	defer l.connsMtx.Unlock()
+	return len(l.conns)
+}
@@ -0,0 +1,126 @@
+package exnet
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketOptions are socket options set on dialed tcp connections, they are
+// set before connect by net.Dialer.Control, except those the kernel
+// resets on connect. Zero values keep the system defaults. They are
+// supported on Linux only, dials fail with ErrSockOptNotSupported on other
+// platforms if any of them is set.
+type SocketOptions struct {
+	// UserTimeout sets TCP_USER_TIMEOUT, the max time transmitted data may
+	// stay unacknowledged before the connection is closed. It's rounded up
+	// to milliseconds, the unit of the option.
+	UserTimeout time.Duration
+	// KeepIdle sets TCP_KEEPIDLE, the idle time before the first keep-alive
+	// probe. It's rounded up to seconds, the unit of the option, and
+	// overrides TCPOptions.KeepAlivePeriod.
+	KeepIdle time.Duration
+	// KeepInterval sets TCP_KEEPINTVL, the interval of keep-alive probes.
+	// It's rounded up to seconds like KeepIdle, and overrides
+	// TCPOptions.KeepAlivePeriod.
+	KeepInterval time.Duration
+	// KeepCount sets TCP_KEEPCNT, the number of unacknowledged probes
+	// before the connection is closed. It overrides the default of
+	// net.Dialer.
+	KeepCount int
+	// RecvBuffer sets SO_RCVBUF, set before connect, so the TCP window
+	// scale is negotiated for it. The kernel doubles it.
+	RecvBuffer int
+	// SendBuffer sets SO_SNDBUF, the kernel doubles it
+	SendBuffer int
+	// QuickAck sets TCP_QUICKACK after connect, it's not permanent, the
+	// kernel may leave quick ack mode later.
+	QuickAck bool
+	// Congestion sets TCP_CONGESTION, the congestion control algorithm,
+	// e.g. "bbr".
+	Congestion string
+	// Mark sets SO_MARK for policy routing, it requires CAP_NET_ADMIN
+	Mark int
+	// TOS sets IP_TOS, or IPV6_TCLASS on IPv6 connections
+	TOS int
+}
+
+func (o *SocketOptions) isZero() bool {
+	return o == nil || *o == SocketOptions{}
+}
+
+// control return a net.Dialer.Control setting o before connect, and calling
+// next after it if next is not nil.
+func (o *SocketOptions) control(next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if !strings.HasPrefix(network, "tcp") {
+			// unix sockets
+			if next != nil {
+				return next(network, address, c)
+			}
+			return nil
+		}
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = o.setPreConnect(fd, network)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			return next(network, address, c)
+		}
+		return nil
+	}
+}
+
+// setPostConnect set options the kernel resets on connect, and keep-alive
+// options which net.Dialer and TCPOptions may have changed.
+func (o *SocketOptions) setPostConnect(conn *net.TCPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = o.setPostConnectFD(fd)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// GetSocketOptions read back socket options of a tcp connection, conn can
+// be an exnet.Conn, over TLS or not. RecvBuffer and SendBuffer are the
+// doubled values of the kernel.
+func GetSocketOptions(conn net.Conn) (*SocketOptions, error) {
+	tc, ok := socketConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil, ErrSockOptNotSupported
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	o := &SocketOptions{}
+	v6 := isIPv6(tc.LocalAddr())
+	cerr := rc.Control(func(fd uintptr) {
+		err = o.get(fd, v6)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func isIPv6(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && ip.To4() == nil
+}
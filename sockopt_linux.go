@@ -0,0 +1,217 @@
+//go:build linux
+// +build linux
+
+package exnet
+
+import (
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// options missing in package syscall
+const (
+	soReusePort    = 0xf
+	tcpFastOpen    = 0x17
+	tcpUserTimeout = 0x12
+
+	ipBindAddressNoPort = 0x18
+)
+
+// control set socket options on a listening socket before bind
+func (lc *ListenConfig) control(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if lc.ReusePort {
+			if err = setsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1, "SO_REUSEPORT"); err != nil {
+				return
+			}
+		}
+		if lc.DeferAccept > 0 {
+			if err = setsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, seconds(lc.DeferAccept), "TCP_DEFER_ACCEPT"); err != nil {
+				return
+			}
+		}
+		if lc.FastOpen > 0 {
+			err = setsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, lc.FastOpen, "TCP_FASTOPEN")
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setBacklog change the backlog of a listening socket, listen(2) can be
+// called again on Linux to do this.
+func setBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return &SockOptError{Option: "backlog", Err: ErrSockOptNotSupported}
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		if e := syscall.Listen(int(fd), backlog); e != nil {
+			err = &SockOptError{Option: "backlog", Err: e}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func setsockoptInt(fd uintptr, level, opt, value int, name string) error {
+	if err := syscall.SetsockoptInt(int(fd), level, opt, value); err != nil {
+		return &SockOptError{Option: name, Err: err}
+	}
+	return nil
+}
+
+func (o *SocketOptions) setPreConnect(fd uintptr, network string) error {
+	type intOpt struct {
+		level, opt, value int
+		name              string
+	}
+	tos := intOpt{syscall.IPPROTO_IP, syscall.IP_TOS, o.TOS, "IP_TOS"}
+	if strings.HasSuffix(network, "6") {
+		tos = intOpt{syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, o.TOS, "IPV6_TCLASS"}
+	}
+	opts := []intOpt{
+		{syscall.IPPROTO_TCP, tcpUserTimeout, milliseconds(o.UserTimeout), "TCP_USER_TIMEOUT"},
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, seconds(o.KeepIdle), "TCP_KEEPIDLE"},
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, seconds(o.KeepInterval), "TCP_KEEPINTVL"},
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepCount, "TCP_KEEPCNT"},
+		{syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuffer, "SO_RCVBUF"},
+		{syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer, "SO_SNDBUF"},
+		{syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark, "SO_MARK"},
+		tos,
+	}
+	for _, opt := range opts {
+		if opt.value == 0 {
+			continue
+		}
+		if err := setsockoptInt(fd, opt.level, opt.opt, opt.value, opt.name); err != nil {
+			return err
+		}
+	}
+	if o.Congestion != "" {
+		if err := syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, o.Congestion); err != nil {
+			return &SockOptError{Option: "TCP_CONGESTION", Err: err}
+		}
+	}
+	return nil
+}
+
+func (o *SocketOptions) setPostConnectFD(fd uintptr) error {
+	if o.KeepIdle > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, seconds(o.KeepIdle), "TCP_KEEPIDLE"); err != nil {
+			return err
+		}
+	}
+	if o.KeepInterval > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, seconds(o.KeepInterval), "TCP_KEEPINTVL"); err != nil {
+			return err
+		}
+	}
+	if o.KeepCount > 0 {
+		if err := setsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepCount, "TCP_KEEPCNT"); err != nil {
+			return err
+		}
+	}
+	if o.QuickAck {
+		return setsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1, "TCP_QUICKACK")
+	}
+	return nil
+}
+
+func (o *SocketOptions) get(fd uintptr, v6 bool) error {
+	tos := struct {
+		level, opt int
+		name       string
+	}{syscall.IPPROTO_IP, syscall.IP_TOS, "IP_TOS"}
+	if v6 {
+		tos.level, tos.opt, tos.name = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, "IPV6_TCLASS"
+	}
+	var ms, idle, intvl, quickAck int
+	opts := []struct {
+		level, opt int
+		name       string
+		value      *int
+	}{
+		{syscall.IPPROTO_TCP, tcpUserTimeout, "TCP_USER_TIMEOUT", &ms},
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, "TCP_KEEPIDLE", &idle},
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, "TCP_KEEPINTVL", &intvl},
+		{syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, "TCP_KEEPCNT", &o.KeepCount},
+		{syscall.SOL_SOCKET, syscall.SO_RCVBUF, "SO_RCVBUF", &o.RecvBuffer},
+		{syscall.SOL_SOCKET, syscall.SO_SNDBUF, "SO_SNDBUF", &o.SendBuffer},
+		{syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, "TCP_QUICKACK", &quickAck},
+		{syscall.SOL_SOCKET, syscall.SO_MARK, "SO_MARK", &o.Mark},
+		{tos.level, tos.opt, tos.name, &o.TOS},
+	}
+	for _, opt := range opts {
+		v, err := syscall.GetsockoptInt(int(fd), opt.level, opt.opt)
+		if err != nil {
+			return &SockOptError{Option: opt.name, Err: err}
+		}
+		*opt.value = v
+	}
+	o.UserTimeout = time.Duration(ms) * time.Millisecond
+	o.KeepIdle = time.Duration(idle) * time.Second
+	o.KeepInterval = time.Duration(intvl) * time.Second
+	o.QuickAck = quickAck != 0
+
+	// TCP_CONGESTION is a string, package syscall has no getter for it
+	buf := make([]byte, 16)
+	n := uint32(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return &SockOptError{Option: "TCP_CONGESTION", Err: errno}
+	}
+	o.Congestion = strings.TrimRight(string(buf[:n]), "\x00")
+	return nil
+}
+
+// seconds round d up to seconds
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func milliseconds(d time.Duration) int {
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// bind fd to ip with port 0
+func (s *sourceAddrs) bind(fd uintptr, ip net.IP) error {
+	if s.conf.BindAddressNoPort {
+		if err := setsockoptInt(fd, syscall.IPPROTO_IP, ipBindAddressNoPort, 1, "IP_BIND_ADDRESS_NO_PORT"); err != nil {
+			return err
+		}
+	}
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip)
+		sa = sa6
+	}
+	return os.NewSyscallError("bind", syscall.Bind(int(fd), sa))
+}
+
+func peerCred(fd uintptr) (*PeerCredentials, error) {
+	ucred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, &SockOptError{Option: "SO_PEERCRED", Err: err}
+	}
+	return &PeerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
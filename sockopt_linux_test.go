@@ -0,0 +1,277 @@
+//go:build linux
+// +build linux
+
+package exnet_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func getsockoptInt(t *testing.T, conn syscall.Conn, level, opt int) int {
+	rc, err := conn.SyscallConn()
+	assert.NoError(t, err)
+	var v int
+	assert.NoError(t, rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	assert.NoError(t, err)
+	return v
+}
+
+func TestListenConfig(t *testing.T) {
+	lc := &exnet.ListenConfig{
+		ReusePort:   true,
+		Backlog:     16,
+		DeferAccept: 1500 * time.Millisecond,
+		FastOpen:    8,
+		TCPOptions:  &exnet.TCPOptions{NoDelay: false, KeepAlive: true, KeepAlivePeriod: 7 * time.Second, Linger: -1},
+	}
+	l1, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l1.Close()
+	// another listener on the same port
+	l2, err := lc.Listen(context.Background(), "tcp", l1.Addr().String())
+	if assert.NoError(t, err) {
+		l2.Close()
+	}
+
+	ul := l1.Underlying().(*net.TCPListener)
+	assert.Equal(t, 1, getsockoptInt(t, ul, syscall.SOL_SOCKET, 0xf))
+	// the kernel rounds it to retransmissions
+	assert.True(t, getsockoptInt(t, ul, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT) >= 2)
+
+	client, err := net.Dial("tcp", l1.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	// deferred until data arrives
+	_, err = client.Write([]byte("x"))
+	assert.NoError(t, err)
+	conn, err := l1.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	tc := exnet.UnwrapConn(conn).(*net.TCPConn)
+	assert.Equal(t, 0, getsockoptInt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	assert.Equal(t, 1, getsockoptInt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+	assert.Equal(t, 7, getsockoptInt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+}
+
+func TestListenConfigError(t *testing.T) {
+	l1, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l1.Close()
+	// the port is taken without SO_REUSEPORT
+	lc := &exnet.ListenConfig{ReusePort: true}
+	_, err = lc.Listen(context.Background(), "tcp", l1.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestSocketOptions(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	o := &exnet.SocketOptions{
+		UserTimeout:  1500 * time.Millisecond,
+		KeepIdle:     20 * time.Second,
+		KeepInterval: 4 * time.Second,
+		KeepCount:    3,
+		RecvBuffer:   64 << 10,
+		SendBuffer:   32 << 10,
+		QuickAck:     true,
+		Congestion:   "reno",
+		TOS:          0x10,
+	}
+	check := func(conn net.Conn) {
+		got, err := exnet.GetSocketOptions(conn)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, o.UserTimeout, got.UserTimeout)
+		assert.Equal(t, o.KeepIdle, got.KeepIdle)
+		assert.Equal(t, o.KeepInterval, got.KeepInterval)
+		assert.Equal(t, o.KeepCount, got.KeepCount)
+		// doubled by the kernel
+		assert.Equal(t, 2*o.RecvBuffer, got.RecvBuffer)
+		assert.Equal(t, 2*o.SendBuffer, got.SendBuffer)
+		assert.Equal(t, o.Congestion, got.Congestion)
+		assert.Equal(t, o.TOS, got.TOS)
+	}
+
+	d := &exnet.Dialer{}
+	d.SetSocketOptions(o)
+	conn, err := d.Dial("tcp", lis.Addr().String())
+	if assert.NoError(t, err) {
+		check(conn)
+		conn.Close()
+	}
+
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", lis.Addr().String()))
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:   time.Second,
+		AddressPicker: ap,
+		SocketOptions: o,
+	})
+	conn, err = cluster.Dial("tcp", "")
+	if assert.NoError(t, err) {
+		// not overridden by TCPOptions.KeepAlivePeriod
+		check(conn)
+		conn.Close()
+	}
+	assert.Equal(t, o, cluster.Config().SocketOptions)
+}
+
+func TestGetSocketOptionsMux(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	mux := exnet.NewMux(lis, &exnet.MuxConfig{SniffTimeout: time.Second})
+	defer mux.Close()
+	anyL := mux.Match(exnet.MatchAny())
+	go func() { _ = mux.Serve() }()
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	_, err = client.Write([]byte("ping"))
+	assert.NoError(t, err)
+	conn, err := anyL.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	// through the bytes replayed
+	_, err = exnet.GetSocketOptions(conn)
+	assert.NoError(t, err)
+}
+
+func TestGetSocketOptionsTLS(t *testing.T) {
+	cert, pool := testCertificate(t, "server")
+	lis, err := exnet.ListenTLS("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if assert.NoError(t, err) {
+			accepted <- conn
+		}
+	}()
+
+	d := &exnet.Dialer{}
+	// rounded up to milliseconds
+	d.SetSocketOptions(&exnet.SocketOptions{UserTimeout: 1500 * time.Microsecond})
+	raw, err := d.Dial("tcp", lis.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := exnet.WithConn(tls.Client(raw, &tls.Config{RootCAs: pool, ServerName: "localhost"}))
+	defer conn.Close()
+	assert.NoError(t, conn.(*exnet.Conn).Underlying().(*tls.Conn).Handshake())
+	got, err := exnet.GetSocketOptions(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2*time.Millisecond, got.UserTimeout)
+	}
+
+	server := <-accepted
+	defer server.Close()
+	_, err = exnet.GetSocketOptions(server)
+	assert.NoError(t, err)
+}
+
+func TestSocketOptionsError(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+
+	d := &exnet.Dialer{}
+	d.SetSocketOptions(&exnet.SocketOptions{Congestion: "no-such-algorithm"})
+	_, err = d.Dial("tcp", lis.Addr().String())
+	var soe *exnet.SockOptError
+	if assert.True(t, errors.As(err, &soe), "%v", err) {
+		assert.Equal(t, "TCP_CONGESTION", soe.Option)
+		assert.Contains(t, err.Error(), "TCP_CONGESTION")
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	sources := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+
+	conf := &exnet.SourceAddrConfig{
+		IPs:               []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("::1"), net.ParseIP("127.0.0.3")},
+		BindAddressNoPort: true,
+	}
+	d := &exnet.Dialer{}
+	d.SetSourceAddr(conf)
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"} {
+		conn, err := d.Dial("tcp", lis.Addr().String())
+		if assert.NoError(t, err) {
+			assert.Equal(t, ip, <-sources)
+			conn.Close()
+		}
+	}
+
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.NoError(t, ap.AppendTCPAddress("tcp", lis.Addr().String()))
+	cluster := exnet.NewCluster(&exnet.ClusterConfig{
+		DialTimeout:   time.Second,
+		AddressPicker: ap,
+		SourceAddr:    conf,
+	})
+	conn, err := cluster.Dial("tcp", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.2", <-sources)
+		conn.Close()
+	}
+	assert.Equal(t, conf, cluster.Config().SourceAddr)
+
+	// an IP not on this host
+	cconf := cluster.Config()
+	cconf.SourceAddr = &exnet.SourceAddrConfig{IPs: []net.IP{net.ParseIP("192.0.2.1")}}
+	assert.NoError(t, cluster.Update(cconf))
+	_, err = cluster.Dial("tcp", "")
+	var anae *exnet.AddrNotAvailableError
+	if assert.True(t, errors.As(err, &anae), "%v", err) {
+		assert.True(t, errors.Is(err, syscall.EADDRNOTAVAIL))
+		assert.True(t, anae.Temporary())
+	}
+	assert.Equal(t, int64(1), cluster.Metrics()["dial_addr_not_available"])
+}
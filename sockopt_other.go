@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package exnet
+
+import (
+	"net"
+	"syscall"
+)
+
+func (lc *ListenConfig) control(network, address string, c syscall.RawConn) error {
+	return ErrSockOptNotSupported
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	return &SockOptError{Option: "backlog", Err: ErrSockOptNotSupported}
+}
+
+func (o *SocketOptions) setPreConnect(fd uintptr, network string) error {
+	return ErrSockOptNotSupported
+}
+
+func (o *SocketOptions) setPostConnectFD(fd uintptr) error {
+	return ErrSockOptNotSupported
+}
+
+func (o *SocketOptions) get(fd uintptr, v6 bool) error {
+	return ErrSockOptNotSupported
+}
+
+func (s *sourceAddrs) bind(fd uintptr, ip net.IP) error {
+	return ErrSockOptNotSupported
+}
+
+func peerCred(fd uintptr) (*PeerCredentials, error) {
+	return nil, ErrSockOptNotSupported
+}
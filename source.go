@@ -0,0 +1,95 @@
+package exnet
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// SourceAddrConfig config for binding dialed connections to local IPs
+type SourceAddrConfig struct {
+	// IPs are the local IPs bound, they are rotated round robin among the
+	// ones of the same family as the remote address, no IP is bound if
+	// there is none of the family.
+	IPs []net.IP
+	// BindAddressNoPort sets IP_BIND_ADDRESS_NO_PORT, so the local port is
+	// chosen at connect, and a port can be used by connections to different
+	// remote addresses. Linux only.
+	BindAddressNoPort bool
+}
+
+// sourceAddrs rotate local IPs of a SourceAddrConfig
+type sourceAddrs struct {
+	conf   *SourceAddrConfig
+	v4, v6 []net.IP
+	next   uint32
+}
+
+func newSourceAddrs(conf *SourceAddrConfig) *sourceAddrs {
+	if conf == nil {
+		return nil
+	}
+	s := &sourceAddrs{conf: conf}
+	for _, ip := range conf.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			s.v4 = append(s.v4, ip4)
+		} else if ip.To16() != nil {
+			s.v6 = append(s.v6, ip)
+		}
+	}
+	return s
+}
+
+// pick return the next local IP for a resolved network, e.g. tcp4, nil for
+// networks not over IP
+func (s *sourceAddrs) pick(network string) net.IP {
+	var ips []net.IP
+	switch network {
+	case "tcp4", "udp4":
+		ips = s.v4
+	case "tcp6", "udp6":
+		ips = s.v6
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	return ips[int(atomic.AddUint32(&s.next, 1)-1)%len(ips)]
+}
+
+// control return a net.Dialer.Control binding a local IP before connect,
+// and calling next before it if next is not nil.
+func (s *sourceAddrs) control(next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if next != nil {
+			if err := next(network, address, c); err != nil {
+				return err
+			}
+		}
+		ip := s.pick(network)
+		if ip == nil {
+			return nil
+		}
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = s.bind(fd, ip)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// SetSourceAddr bind dialed connections to local IPs, nil removes it
+func (d *Dialer) SetSourceAddr(conf *SourceAddrConfig) {
+	d.source = newSourceAddrs(conf)
+}
+
+// addrNotAvailable wrap err in AddrNotAvailableError if it's EADDRNOTAVAIL
+func addrNotAvailable(network, address string, err error) error {
+	if err != nil && errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return &AddrNotAvailableError{Network: network, Address: address, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package exnet
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TimeoutConfig is the timeout policies of connections accepted by Listener
+type TimeoutConfig struct {
+	// IdleTimeout fails a Read or Write if there is no successful Read or
+	// Write in either direction for the duration, so any progress extends
+	// it. Time spent without Read or Write in progress, e.g. handling a
+	// request, is not counted.
+	IdleTimeout time.Duration
+	// ReadTimeout is the max duration of every Read call
+	ReadTimeout time.Duration
+	// WriteTimeout is the max duration of every Write call
+	WriteTimeout time.Duration
+}
+
+// SetTimeouts apply timeout policies to accepted connections, nil disables
+// them. Deadlines set by users of the connections, e.g. http.Server, are
+// kept, the earliest of them and the policies takes effect. It doesn't
+// change connections already accepted, and it's safe to call while
+// accepting.
+func (l *Listener) SetTimeouts(conf *TimeoutConfig) {
+	l.timeouts.Store(conf)
+}
+
+// loadTimeouts return the current timeout policies or nil
+func (l *Listener) loadTimeouts() *TimeoutConfig {
+	conf, _ := l.timeouts.Load().(*TimeoutConfig)
+	return conf
+}
+
+// connTimeouts arms deadlines of a connection by timeout policies, it's
+// guarded by a mutex as Read and Write may be called concurrently.
+type connTimeouts struct {
+	idle  time.Duration
+	read  time.Duration
+	write time.Duration
+
+	mtx sync.Mutex
+	// deadlines set by user
+	userRead  time.Time
+	userWrite time.Time
+	// start time of the Read or Write in progress, zero if there's none
+	readStart  time.Time
+	writeStart time.Time
+	// lastActive is the time of last successful Read or Write
+	lastActive time.Time
+}
+
+func newConnTimeouts(conf *TimeoutConfig) *connTimeouts {
+	if conf == nil || (conf.IdleTimeout <= 0 && conf.ReadTimeout <= 0 && conf.WriteTimeout <= 0) {
+		return nil
+	}
+	return &connTimeouts{
+		idle:  conf.IdleTimeout,
+		read:  conf.ReadTimeout,
+		write: conf.WriteTimeout,
+	}
+}
+
+func (t *connTimeouts) beginRead(conn net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.readStart = time.Now()
+	_ = conn.SetReadDeadline(t.readDeadline())
+}
+
+func (t *connTimeouts) endRead(conn net.Conn, active bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.readStart = time.Time{}
+	t.activate(conn, active)
+}
+
+func (t *connTimeouts) beginWrite(conn net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.writeStart = time.Now()
+	_ = conn.SetWriteDeadline(t.writeDeadline())
+}
+
+func (t *connTimeouts) endWrite(conn net.Conn, active bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.writeStart = time.Time{}
+	t.activate(conn, active)
+}
+
+// activate extend the idle deadline after a successful Read or Write, a
+// Read or Write in progress in the other direction gets the new deadline,
+// and the deadline of this direction is released until its next call.
+func (t *connTimeouts) activate(conn net.Conn, active bool) {
+	if !active || t.idle <= 0 {
+		return
+	}
+	t.lastActive = time.Now()
+	_ = conn.SetReadDeadline(t.readDeadline())
+	_ = conn.SetWriteDeadline(t.writeDeadline())
+}
+
+func (t *connTimeouts) setReadDeadline(conn net.Conn, d time.Time) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.userRead = d
+	return conn.SetReadDeadline(t.readDeadline())
+}
+
+func (t *connTimeouts) setWriteDeadline(conn net.Conn, d time.Time) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.userWrite = d
+	return conn.SetWriteDeadline(t.writeDeadline())
+}
+
+func (t *connTimeouts) readDeadline() time.Time {
+	return earliest(t.userRead, after(t.readStart, t.read), after(t.idleSince(t.readStart), t.idle))
+}
+
+func (t *connTimeouts) writeDeadline() time.Time {
+	return earliest(t.userWrite, after(t.writeStart, t.write), after(t.idleSince(t.writeStart), t.idle))
+}
+
+// idleSince return the start of idle time of an operation started at start,
+// zero if it's not in progress.
+func (t *connTimeouts) idleSince(start time.Time) time.Time {
+	if start.IsZero() {
+		return time.Time{}
+	}
+	if t.lastActive.After(start) {
+		return t.lastActive
+	}
+	return start
+}
+
+// after return t+d, zero if t is zero or d is not positive
+func after(t time.Time, d time.Duration) time.Time {
+	if t.IsZero() || d <= 0 {
+		return time.Time{}
+	}
+	return t.Add(d)
+}
+
+// earliest return the earliest non-zero time, zero if all are zero
+func earliest(ts ...time.Time) time.Time {
+	var e time.Time
+	for _, t := range ts {
+		if !t.IsZero() && (e.IsZero() || t.Before(e)) {
+			e = t
+		}
+	}
+	return e
+}
@@ -0,0 +1,175 @@
+package exnet_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+)
+
+func acceptPair(t *testing.T, conf *exnet.TimeoutConfig) (client, server net.Conn, closeFunc func()) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	lis.SetTimeouts(conf)
+	client, err = net.Dial("tcp", lis.Addr().String())
+	assert.NoError(t, err)
+	server, err = lis.Accept()
+	assert.NoError(t, err)
+	return client, server, func() {
+		client.Close()
+		server.Close()
+		lis.Close()
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	client, server, closeFunc := acceptPair(t, &exnet.TimeoutConfig{IdleTimeout: 100 * time.Millisecond})
+	defer closeFunc()
+
+	// reads keep the connection alive beyond the idle timeout
+	go func() {
+		for i := 0; i < 6; i++ {
+			time.Sleep(40 * time.Millisecond)
+			_, _ = client.Write([]byte{'x'})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 6; i++ {
+		_, err := server.Read(buf)
+		assert.NoError(t, err)
+	}
+
+	// time without Read in progress is not idle
+	time.Sleep(150 * time.Millisecond)
+	go func() { _, _ = client.Write([]byte{'x'}) }()
+	_, err := server.Read(buf)
+	assert.NoError(t, err)
+
+	// silence times out
+	start := time.Now()
+	_, err = server.Read(buf)
+	assert.True(t, isTimeout(err), "%v", err)
+	assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+}
+
+func TestListenerIdleTimeoutWriteExtendsRead(t *testing.T) {
+	client, server, closeFunc := acceptPair(t, &exnet.TimeoutConfig{IdleTimeout: 100 * time.Millisecond})
+	defer closeFunc()
+
+	// a blocked Read is extended by successful Writes
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	for i := 0; i < 6; i++ {
+		time.Sleep(40 * time.Millisecond)
+		_, err := server.Write([]byte{'x'})
+		assert.NoError(t, err)
+	}
+	_, err := client.Write([]byte{'x'})
+	assert.NoError(t, err)
+	assert.NoError(t, <-readErr)
+}
+
+func TestListenerReadTimeout(t *testing.T) {
+	_, server, closeFunc := acceptPair(t, &exnet.TimeoutConfig{ReadTimeout: 100 * time.Millisecond})
+	defer closeFunc()
+	buf := make([]byte, 1)
+
+	// armed on every call
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		_, err := server.Read(buf)
+		assert.True(t, isTimeout(err), "%v", err)
+		assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+	}
+
+	// an earlier deadline of user takes effect, a later one doesn't extend
+	// the timeout
+	assert.NoError(t, server.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+	start := time.Now()
+	_, err := server.Read(buf)
+	assert.True(t, isTimeout(err), "%v", err)
+	assert.InDelta(t, 20*time.Millisecond, time.Since(start), float64(15*time.Millisecond))
+
+	assert.NoError(t, server.SetDeadline(time.Now().Add(time.Hour)))
+	start = time.Now()
+	_, err = server.Read(buf)
+	assert.True(t, isTimeout(err), "%v", err)
+	assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+}
+
+func TestListenerSetTimeoutsWhileAccepting(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// run with -race, policies are read by Accept
+	for i := 0; i < 5; i++ {
+		lis.SetTimeouts(&exnet.TimeoutConfig{ReadTimeout: time.Duration(i+1) * 20 * time.Millisecond})
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if !assert.NoError(t, err) {
+			continue
+		}
+		server := <-accepted
+		_, err = server.Read(make([]byte, 1))
+		assert.True(t, isTimeout(err), "%v", err)
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestListenerTimeoutsHTTP(t *testing.T) {
+	lis, err := exnet.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer lis.Close()
+	lis.SetTimeouts(&exnet.TimeoutConfig{
+		IdleTimeout:  100 * time.Millisecond,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	srv := &http.Server{
+		// http.Server sets its own deadlines
+		ReadTimeout: time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// longer than idle timeout
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "hello")
+		}),
+	}
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + lis.Addr().String())
+	if assert.NoError(t, err) {
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+		resp.Body.Close()
+	}
+
+	// the kept-alive connection is closed after idle timeout
+	assert.Eventually(t, func() bool { return len(lis.ActiveConns()) == 0 }, time.Second, 10*time.Millisecond)
+}
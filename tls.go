@@ -0,0 +1,186 @@
+package exnet
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultCertReloadInterval = 10 * time.Second
+
+// TLSConnectionState return the TLS state of conn, false if conn is not an
+// exnet.Conn over TLS.
+func TLSConnectionState(conn net.Conn) (*tls.ConnectionState, bool) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return nil, false
+	}
+	tlsConn, ok := c._conn.(*tls.Conn)
+	if !ok {
+		return nil, false
+	}
+	state := tlsConn.ConnectionState()
+	return &state, true
+}
+
+// PeerIdentity return subject of the verified peer certificate of conn, e.g.
+// "CN=client,O=exnet", empty if conn is not over TLS or the peer is not
+// verified.
+func PeerIdentity(conn net.Conn) string {
+	state, ok := TLSConnectionState(conn)
+	if !ok || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
+
+// CertReloader load a certificate and its key from files, and reload them
+// when the files change, so new handshakes use the new certificate while
+// existing connections are kept. Use GetCertificate for servers, e.g. in
+// tls.Config of Listener, and GetClientCertificate for clients.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	onError  func(error)
+
+	// current *tls.Certificate
+	cert atomic.Value
+
+	mtx      sync.Mutex
+	certStat os.FileInfo
+	keyStat  os.FileInfo
+	stopch   chan struct{}
+	donech   chan struct{}
+}
+
+// NewCertReloader load certificate and key, polls the files every interval
+// after Watch called, default interval is 10 seconds.
+// onError is called if a reload failed, the last good certificate is kept,
+// it can be nil.
+func NewCertReloader(certFile, keyFile string, interval time.Duration, onError func(error)) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		onError:  onError,
+	}
+	if r.interval <= 0 {
+		r.interval = defaultCertReloadInterval
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Certificate return the current certificate
+func (r *CertReloader) Certificate() *tls.Certificate {
+	return r.cert.Load().(*tls.Certificate)
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Reload certificate and key from files
+func (r *CertReloader) Reload() error {
+	certStat, keyStat := stat(r.certFile), stat(r.keyFile)
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.certStat, r.keyStat = certStat, keyStat
+	return nil
+}
+
+// Watch start polling the files in background until Close called
+func (r *CertReloader) Watch() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.stopch != nil {
+		return
+	}
+	r.stopch = make(chan struct{})
+	r.donech = make(chan struct{})
+	go r.poll(r.stopch, r.donech)
+}
+
+// Close stop watching the files
+func (r *CertReloader) Close() error {
+	r.mtx.Lock()
+	stopch, donech := r.stopch, r.donech
+	r.stopch, r.donech = nil, nil
+	r.mtx.Unlock()
+
+	if stopch != nil {
+		close(stopch)
+		<-donech
+	}
+	return nil
+}
+
+func (r *CertReloader) poll(stopch, donech chan struct{}) {
+	defer close(donech)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopch:
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil && r.onError != nil {
+			r.onError(err)
+		}
+	}
+}
+
+// changed report whether the files changed since last check, a half
+// written pair fails to load and is retried on the next change.
+func (r *CertReloader) changed() bool {
+	certStat, keyStat := stat(r.certFile), stat(r.keyFile)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if sameStat(certStat, r.certStat) && sameStat(keyStat, r.keyStat) {
+		return false
+	}
+	r.certStat, r.keyStat = certStat, keyStat
+	return true
+}
+
+func stat(path string) os.FileInfo {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return fi
+}
+
+// sameStat report whether a and b are the same version of a file, a file
+// replaced by rename is a different one even if modified in the same tick.
+func sameStat(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,15 @@
+//go:build !go1.18
+// +build !go1.18
+
+package exnet
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// tlsNetConn return nil, the connection under c is not exposed before Go
+// 1.18
+func tlsNetConn(c *tls.Conn) net.Conn {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build go1.18
+// +build go1.18
+
+package exnet
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// tlsNetConn return the connection under c
+func tlsNetConn(c *tls.Conn) net.Conn {
+	return c.NetConn()
+}
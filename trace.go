@@ -1,6 +1,7 @@
 package exnet
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -19,6 +20,10 @@ type ConnTracer struct {
 	TraceSetDeadlineFunc      func(conn net.Conn, t time.Time, err error)
 	TraceSetReadDeadlineFunc  func(conn net.Conn, t time.Time, err error)
 	TraceSetWriteDeadlineFunc func(conn net.Conn, t time.Time, err error)
+	TraceHandshakeFunc        func(conn net.Conn, state *tls.ConnectionState, err error)
+	TraceProxyHeaderFunc      func(conn net.Conn, header *ProxyHeader, err error)
+	TraceRejectFunc           func(conn net.Conn, err error)
+	TraceEgressFunc           func(network, address string, err error)
 }
 
 // ReadTracer interface
@@ -99,6 +104,32 @@ func (f TraceSetWriteDeadline) TraceSetWriteDeadline(conn net.Conn, t time.Time,
 	f(conn, t, err)
 }
 
+// HandshakeTracer interface
+type HandshakeTracer interface {
+	TraceHandshake(conn net.Conn, state *tls.ConnectionState, err error)
+}
+
+// TraceHandshake is function implement HandshakeTracer interface
+type TraceHandshake func(conn net.Conn, state *tls.ConnectionState, err error)
+
+// TraceHandshake implement HandshakeTracer interface
+func (f TraceHandshake) TraceHandshake(conn net.Conn, state *tls.ConnectionState, err error) {
+	f(conn, state, err)
+}
+
+// ProxyHeaderTracer interface
+type ProxyHeaderTracer interface {
+	TraceProxyHeader(conn net.Conn, header *ProxyHeader, err error)
+}
+
+// TraceProxyHeader is function implement ProxyHeaderTracer interface
+type TraceProxyHeader func(conn net.Conn, header *ProxyHeader, err error)
+
+// TraceProxyHeader implement ProxyHeaderTracer interface
+func (f TraceProxyHeader) TraceProxyHeader(conn net.Conn, header *ProxyHeader, err error) {
+	f(conn, header, err)
+}
+
 var (
 	_ ReadTracer             = &ConnTracer{}
 	_ WriteTracer            = &ConnTracer{}
@@ -106,6 +137,10 @@ var (
 	_ SetDeadlineTracer      = &ConnTracer{}
 	_ SetReadDeadlineTracer  = &ConnTracer{}
 	_ SetWriteDeadlineTracer = &ConnTracer{}
+	_ HandshakeTracer        = &ConnTracer{}
+	_ ProxyHeaderTracer      = &ConnTracer{}
+	_ RejectTracer           = &ConnTracer{}
+	_ EgressTracer           = &ConnTracer{}
 )
 
 func (ct *ConnTracer) TraceRead(conn net.Conn, data []byte, err error) {
@@ -195,7 +230,51 @@ func (ct *ConnTracer) TraceSetWriteDeadline(conn net.Conn, t time.Time, err erro
 	}
 }
 
+func (ct *ConnTracer) TraceHandshake(conn net.Conn, state *tls.ConnectionState, err error) {
+	if ct.TraceHandshakeFunc != nil {
+		ct.TraceHandshakeFunc(conn, state, err)
+		return
+	}
+	if err != nil {
+		ct.logger().Printf("%s handshake error: %s", ct.connString(conn), err.Error())
+	} else {
+		ct.logger().Printf("%s handshake done, version %x, cipher suite %x",
+			ct.connString(conn), state.Version, state.CipherSuite)
+	}
+}
+
+func (ct *ConnTracer) TraceProxyHeader(conn net.Conn, header *ProxyHeader, err error) {
+	if ct.TraceProxyHeaderFunc != nil {
+		ct.TraceProxyHeaderFunc(conn, header, err)
+		return
+	}
+	if err != nil {
+		ct.logger().Printf("%s proxy header error: %s", ct.connString(conn), err.Error())
+	} else {
+		ct.logger().Printf("%s proxy header v%d", ct.connString(conn), header.Version)
+	}
+}
+
+func (ct *ConnTracer) TraceReject(conn net.Conn, err error) {
+	if ct.TraceRejectFunc != nil {
+		ct.TraceRejectFunc(conn, err)
+		return
+	}
+	ct.logger().Printf("%s rejected: %s", ct.connString(conn), err.Error())
+}
+
+func (ct *ConnTracer) TraceEgress(network, address string, err error) {
+	if ct.TraceEgressFunc != nil {
+		ct.TraceEgressFunc(network, address, err)
+		return
+	}
+	ct.logger().Printf("(%s %s) egress denied: %s", network, address, err.Error())
+}
+
 func (ct *ConnTracer) connString(conn net.Conn) string {
+	if peer := PeerIdentity(conn); peer != "" {
+		return fmt.Sprintf("(%s|%s %s)", conn.LocalAddr().String(), conn.RemoteAddr().String(), peer)
+	}
 	return fmt.Sprintf("(%s|%s)", conn.LocalAddr().String(), conn.RemoteAddr().String())
 }
 
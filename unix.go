@@ -0,0 +1,36 @@
+package exnet
+
+import (
+	"net"
+)
+
+// PeerCredentials are credentials of the peer process of a unix socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// PeerCred return credentials of the process connected to a unix socket
+// conn by SO_PEERCRED, e.g. an exnet.Conn accepted by Listener, over TLS or
+// Mux or not. They are of the process when it connected, and can authorize
+// local clients. Linux only, ErrSockOptNotSupported is returned on other
+// platforms.
+func PeerCred(conn net.Conn) (*PeerCredentials, error) {
+	uc, ok := socketConn(conn).(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnixConn
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *PeerCredentials
+	cerr := rc.Control(func(fd uintptr) {
+		cred, err = peerCred(fd)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	return cred, err
+}
@@ -0,0 +1,124 @@
+//go:build linux
+// +build linux
+
+package exnet_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eddix/exnet"
+	"github.com/eddix/exnet/addresspicker"
+)
+
+func TestClusterUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, address := range []string{
+		filepath.Join(dir, "exnet.sock"),
+		fmt.Sprintf("@exnet-test-%d", os.Getpid()),
+	} {
+		lis, err := exnet.Listen("unix", address)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		creds := make(chan *exnet.PeerCredentials, 1)
+		go func() {
+			conn, err := lis.Accept()
+			if !assert.NoError(t, err) {
+				return
+			}
+			cred, err := exnet.PeerCred(conn)
+			assert.NoError(t, err)
+			creds <- cred
+			_, _ = conn.Write([]byte("hello"))
+			conn.Close()
+		}()
+
+		ap := addresspicker.NewRoundRobin(nil)
+		assert.NoError(t, ap.AppendUnixAddress("unix", address))
+		cluster := exnet.NewCluster(&exnet.ClusterConfig{
+			DialTimeout:   time.Second,
+			AddressPicker: ap,
+			// not applied to unix sockets
+			SocketOptions: &exnet.SocketOptions{KeepCount: 3},
+			SourceAddr:    &exnet.SourceAddrConfig{IPs: []net.IP{net.ParseIP("127.0.0.1")}},
+		})
+		conn, err := cluster.Dial("unix", "")
+		if assert.NoError(t, err, address) {
+			data, err := ioutil.ReadAll(conn)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(data))
+			conn.Close()
+
+			cred := <-creds
+			assert.Equal(t, int32(os.Getpid()), cred.PID)
+			assert.Equal(t, uint32(os.Getuid()), cred.UID)
+			assert.Equal(t, uint32(os.Getgid()), cred.GID)
+		}
+		lis.Close()
+	}
+}
+
+func TestPeerCredTLSMux(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exnet")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "exnet.sock")
+	cert, pool := testCertificate(t, "server")
+	lis, err := exnet.ListenTLS("unix", path, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := exnet.NewMux(lis, &exnet.MuxConfig{SniffTimeout: time.Second})
+	defer mux.Close()
+	anyL := mux.Match(exnet.MatchAny())
+	go func() { _ = mux.Serve() }()
+
+	conn, err := tls.Dial("unix", path, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	server, err := anyL.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	cred, err := exnet.PeerCred(server)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int32(os.Getpid()), cred.PID)
+	}
+}
+
+func TestPeerCredNotUnix(t *testing.T) {
+	client, server, closeFunc := acceptPair(t, nil)
+	defer closeFunc()
+	_, err := exnet.PeerCred(server)
+	assert.Equal(t, exnet.ErrNotUnixConn, err)
+	_, err = exnet.PeerCred(client)
+	assert.Equal(t, exnet.ErrNotUnixConn, err)
+}
+
+func TestAppendUnixAddress(t *testing.T) {
+	ap := addresspicker.NewRoundRobin(nil)
+	assert.Error(t, ap.AppendUnixAddress("unixgram", "/tmp/x.sock"))
+	assert.Error(t, ap.AppendUnixAddress("tcp", "/tmp/x.sock"))
+	assert.Error(t, ap.AppendUnixAddress("unix", ""))
+	assert.NoError(t, ap.AppendUnixAddress("unixpacket", "@x"))
+	addr := ap.Addr()
+	assert.Equal(t, "unixpacket", addr.Network())
+	assert.Equal(t, "@x", addr.String())
+}